@@ -1,49 +1,158 @@
 package main
 
 import (
+	"context"
+	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/alecthomas/kingpin"
 
-	"github.com/npotts/music-hasher/hasher"
+	"github.com/nppotts/music-hasher/hasher"
 )
 
 var (
 	cwd, _  = os.Getwd()
 	db      = kingpin.Flag("db", `Path to Music database to populate`).Short('d').Default(cwd + "/music.db").String()
 	goprocs = kingpin.Flag("procs", "Use this number of processes to scrape data; number of concurrent filesystem readers to utilize").Short('p').Default("10").Int()
+	dryRun  = kingpin.Flag("dry-run", "Report what would be deleted, moved or rewritten without touching files or committing to the database").Bool()
 
 	assemble = kingpin.Command("assemble", "Assemble a Database by scraping a path")
 	asroot   = assemble.Arg("PATH", "Root path to start walking looking for files").ExistingDir()
+	asbatch  = assemble.Flag("batch", "Number of scanned files written to the database per transaction").Default(strconv.Itoa(hasher.DefaultBatchSize)).Int()
+	asfull   = assemble.Flag("full-hash", "Hash every file in full, rather than only those whose size and partial hash match another's").Bool()
+	asflush  = assemble.Flag("flush-every", "Longest to hold scanned files before writing them to the database").Default(hasher.DefaultFlushInterval.String()).Duration()
 
-	analyze = kingpin.Command("analyze", "Analyze data to look for duplicates")
+	analyze  = kingpin.Command("analyze", "Analyze data to look for duplicates")
+	policy   = analyze.Flag("policy", "YAML file of rules used to pick which duplicate to keep; only ties are prompted for").ExistingFile()
+	anresume = analyze.Flag("resume", "Carry on the last review that was quit or interrupted, from the stage it stopped in").Bool()
+	anprint  = analyze.Flag("fingerprint", "Also fingerprint the audio of MP3s and group files that sound alike, across encodings and bitrates").Bool()
+	anfuzzy  = analyze.Flag("fuzzy-threshold", "How alike, from 0 to 1, normalised artist, album and title must be to list files in fuzzy_candidates; 0 skips this").Default(strconv.FormatFloat(hasher.DefaultFuzzyThreshold, 'f', -1, 64)).Float64()
+	anlength = analyze.Flag("duration-tolerance", "Files with the same tags whose lengths differ by more than this are left as possible different versions rather than duplicates").Default(hasher.DefaultDurationTolerance.String()).Duration()
+	anthres  = analyze.Flag("fingerprint-threshold", "Fraction of fingerprint bits two files must share to be grouped, from 0.5 (unrelated) to 1").Default(strconv.FormatFloat(hasher.DefaultFingerprintThreshold, 'f', -1, 64)).Float64()
 
-	dupNuke = kingpin.Command("dup-nuke", "Nuke (RM) located duplicated")
+	dupNuke    = kingpin.Command("dup-nuke", "Nuke (RM) located duplicated")
+	quarantine = dupNuke.Flag("quarantine", "Move duplicates into a tree mirroring their paths under DIR rather than removing them").PlaceHolder("DIR").String()
+	nukePrune  = dupNuke.Flag("prune-dirs", "Afterwards, remove directories left empty under the assembled roots").Bool()
 
-	moveKnown = kingpin.Command("move", "Move non-duplicatd files into another folder tree preserving <root>/<Artist>/<album>/<title> heirarchy")
-	moveWhere = moveKnown.Arg("WHERE", "Move files to directory rooted here").ExistingDir()
+	dupLink    = kingpin.Command("dup-link", "Replace located duplicates with hardlinks, or symlinks across filesystems, to the files kept in their place")
+	dupReflink = kingpin.Command("dup-reflink", "Share the blocks of byte-identical duplicates with the files kept in their place, on filesystems such as Btrfs and XFS that support it")
+
+	restore      = kingpin.Command("restore", "Move quarantined files back to where they came from")
+	restoreUnder = restore.Arg("PATH", "Only restore files that were originally under PATH").String()
+
+	purge          = kingpin.Command("purge", "Permanently remove quarantined files")
+	purgeOlderThan = purge.Flag("older-than", "Only purge files quarantined at least this long ago, eg 720h; 0s purges everything").Required().Duration()
+
+	moveKnown    = kingpin.Command("move", "Move non-duplicatd files into another folder tree preserving <root>/<Artist>/<album>/<title> heirarchy")
+	moveWhere    = moveKnown.Arg("WHERE", "Move files to directory rooted here").ExistingDir()
+	moveFormat   = moveKnown.Flag("format", `Go text/template for the path under WHERE; helpers: pad, albumArtist, disc, yearPrefix, letter. eg {{albumArtist .}}/{{yearPrefix .Year}}{{.Album}}/{{.DiskNo}}-{{pad 2 .TrackNo}} {{.Title}}{{.Extension}}`).Default(hasher.DefaultFormat).String()
+	moveConflict = moveKnown.Flag("on-conflict", "When the destination exists: skip; suffix the name; overwrite-if-better quality; or compare, recording identical files as duplicates").Default(hasher.ConflictSkip).Enum(hasher.ConflictPolicies...)
+	moveProfile  = moveKnown.Flag("fs-profile", "Make names safe for this kind of filesystem: posix or windows; fat32 and smb are the same as windows").Default("posix").Enum("posix", "windows", "fat32", "smb")
+	movePrune    = moveKnown.Flag("prune-dirs", "Afterwards, remove directories left empty under the assembled roots").Bool()
+
+	pruneDirs      = kingpin.Command("prune-dirs", "Remove directories that are empty or hold only junk like .DS_Store, never going above the assembled roots")
+	pruneDirsUnder = pruneDirs.Arg("PATH", "Only prune below PATH").ExistingDir()
+
+	undo   = kingpin.Command("undo", "Reverse a move, putting files back where they came from")
+	undoOp = undo.Flag("op", "Operation id logged by move").Required().Int64()
 )
 
 func panicIf(err error) {
+	exitIfInterrupted(err)
 	if err != nil {
 		panic(err)
 	}
 }
 
+//exitIfInterrupted exits quietly if err is only that the run was interrupted
+func exitIfInterrupted(err error) {
+	if err == context.Canceled {
+		log.Println("Interrupted; run the same command again to carry on where it stopped")
+		os.Exit(130)
+	}
+}
+
+/*interruptible returns a context that is cancelled on the first SIGINT or
+SIGTERM, letting the current step finish and its work be saved.  A second
+signal exits immediately.*/
+func interruptible() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Println("Stopping once the current step is saved; interrupt again to quit now")
+		cancel()
+		<-sigs
+		os.Exit(130)
+	}()
+	return ctx
+}
+
 func main() {
 	which := kingpin.Parse()
 
 	fdb := hasher.CreateFileDB(*db)
 	defer fdb.Close()
+	fdb.SetDryRun(*dryRun)
+	ctx := interruptible()
 
 	switch which {
 	case assemble.FullCommand():
-		fdb.PopulateDB(*asroot, *goprocs)
+		fdb.SetBatchSize(*asbatch)
+		fdb.SetFlushInterval(*asflush)
+		fdb.SetFullHashing(*asfull)
+		err := fdb.PopulateDB(ctx, *asroot, *goprocs)
+		exitIfInterrupted(err)
+		kingpin.FatalIfError(err, "assemble")
 	case analyze.FullCommand():
-		panicIf(fdb.Prune())
+		if *policy != "" {
+			p, err := hasher.LoadPolicy(*policy)
+			panicIf(err)
+			fdb.UsePolicy(p)
+		}
+		fdb.SetFuzzyThreshold(*anfuzzy)
+		fdb.SetDurationTolerance(*anlength)
+		if *anprint {
+			fdb.UseFingerprints(*anthres, *goprocs)
+		}
+		fdb.SetResume(*anresume)
+		err := fdb.Prune(ctx)
+		switch err {
+		case hasher.ErrReviewPaused:
+			log.Println(err)
+			return
+		case context.Canceled:
+			log.Println("Interrupted; run analyze --resume to carry on where it stopped")
+			os.Exit(130)
+		}
+		panicIf(err)
 	case dupNuke.FullCommand():
-		panicIf(fdb.DupNuker())
+		panicIf(fdb.DupNuker(ctx, *quarantine))
+		if *nukePrune {
+			panicIf(fdb.PruneDirs(""))
+		}
+	case dupLink.FullCommand():
+		panicIf(fdb.DupLinker())
+	case dupReflink.FullCommand():
+		panicIf(fdb.DupReflinker())
+	case restore.FullCommand():
+		panicIf(fdb.Restore(*restoreUnder))
+	case purge.FullCommand():
+		panicIf(fdb.Purge(*purgeOlderThan))
 	case moveKnown.FullCommand():
-		panicIf(fdb.RenameInto(*moveWhere))
+		panicIf(fdb.UseFormat(*moveFormat, *moveProfile))
+		panicIf(fdb.SetConflictPolicy(*moveConflict))
+		panicIf(fdb.RenameInto(ctx, *moveWhere))
+		if *movePrune {
+			panicIf(fdb.PruneDirs(""))
+		}
+	case pruneDirs.FullCommand():
+		panicIf(fdb.PruneDirs(*pruneDirsUnder))
+	case undo.FullCommand():
+		panicIf(fdb.Undo(*undoOp))
 	}
 }
@@ -10,10 +10,13 @@ require (
 	github.com/dhowden/itl v0.0.0-20170329215456-9fbe21093131 // indirect
 	github.com/dhowden/plist v0.0.0-20141002110153-5db6e0d9931a // indirect
 	github.com/dhowden/tag v0.0.0-20201120070457-d52dcb253c63
+	github.com/hajimehoshi/go-mp3 v0.3.4
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/manifoldco/promptui v0.8.0
 	github.com/mattn/go-sqlite3 v1.14.5
 	github.com/nbutton23/zxcvbn-go v0.0.0-20180912185939-ae427f1e4c1d // indirect
-	github.com/npotts/music-hasher v0.0.0-20200815210226-35a06b4e3597
 	github.com/xlab/tablewriter v0.0.0-20160610135559-80b567a11ad5
+	golang.org/x/sys v0.1.0
+	golang.org/x/text v0.3.8
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,166 @@
+package hasher
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+)
+
+//byteRange is a [start, end) span of a file
+type byteRange struct {
+	start, end int64
+}
+
+/*audioPayload returns the spans of f that hold the audio itself, leaving out
+any tag blocks.  It returns nil if the container is not one it understands.*/
+func audioPayload(f io.ReaderAt, size int64) []byteRange {
+	if isMP4(f) {
+		return mp4Payload(f, size)
+	}
+	return mp3Payload(f, size)
+}
+
+//isMP4 returns true if f opens with an ISO-BMFF ftyp box
+func isMP4(f io.ReaderAt) bool {
+	magic := make([]byte, 8)
+	_, err := f.ReadAt(magic, 0)
+	return err == nil && string(magic[4:8]) == "ftyp"
+}
+
+func synchsafe(b []byte) int64 {
+	return int64(b[0]&0x7f)<<21 | int64(b[1]&0x7f)<<14 | int64(b[2]&0x7f)<<7 | int64(b[3]&0x7f)
+}
+
+//isFrameSync returns true if b starts with an MPEG audio frame sync
+func isFrameSync(b []byte) bool {
+	return len(b) > 1 && b[0] == 0xff && b[1]&0xe0 == 0xe0
+}
+
+/*mp3Payload skips leading ID3v2 tags and their padding, and trailing ID3v1,
+Lyrics3v2 and APE tags.*/
+func mp3Payload(f io.ReaderAt, size int64) []byteRange {
+	start, end := mp3AudioStart(f, size), size
+
+	buf := make([]byte, 32)
+	for trimmed := true; trimmed; {
+		trimmed = false
+		if end-start >= 128 {
+			if _, err := f.ReadAt(buf[:3], end-128); err == nil && string(buf[:3]) == "TAG" {
+				end -= 128
+				trimmed = true
+			}
+		}
+		if end-start >= 15 {
+			if _, err := f.ReadAt(buf[:15], end-15); err == nil && string(buf[6:15]) == "LYRICS200" {
+				if n, err := strconv.ParseInt(string(buf[:6]), 10, 64); err == nil && n+15 <= end-start {
+					end -= n + 15
+					trimmed = true
+				}
+			}
+		}
+		if end-start >= 32 {
+			if _, err := f.ReadAt(buf[:32], end-32); err == nil && string(buf[:8]) == "APETAGEX" {
+				n := int64(binary.LittleEndian.Uint32(buf[12:16]))
+				if binary.LittleEndian.Uint32(buf[20:24])&(1<<31) != 0 {
+					n += 32 //header present
+				}
+				if n <= end-start {
+					end -= n
+					trimmed = true
+				}
+			}
+		}
+	}
+
+	sync := make([]byte, 2)
+	if _, err := f.ReadAt(sync, start); err != nil || !isFrameSync(sync) {
+		return nil
+	}
+	return []byteRange{{start, end}}
+}
+
+//mp3AudioStart returns the offset just past any ID3v2 tags and the padding after them
+func mp3AudioStart(f io.ReaderAt, size int64) int64 {
+	start := int64(0)
+	hdr := make([]byte, 10)
+	for {
+		if _, err := f.ReadAt(hdr, start); err != nil || string(hdr[:3]) != "ID3" {
+			break
+		}
+		start += synchsafe(hdr[6:10]) + 10
+		if hdr[5]&0x10 != 0 {
+			start += 10 //footer
+		}
+	}
+
+	b := make([]byte, 1)
+	for start < size {
+		if _, err := f.ReadAt(b, start); err != nil || b[0] != 0 {
+			break
+		}
+		start++
+	}
+	return start
+}
+
+//mp4Box is a single ISO-BMFF box; start and end bound its payload
+type mp4Box struct {
+	typ        string
+	start, end int64
+}
+
+//mp4Boxes lists the boxes found between start and end
+func mp4Boxes(f io.ReaderAt, start, end int64) []mp4Box {
+	boxes := []mp4Box{}
+	hdr := make([]byte, 16)
+	for off := start; off+8 <= end; {
+		if _, err := f.ReadAt(hdr[:8], off); err != nil {
+			break
+		}
+		sz, hlen := int64(binary.BigEndian.Uint32(hdr[:4])), int64(8)
+		switch sz {
+		case 0:
+			sz = end - off
+		case 1:
+			if _, err := f.ReadAt(hdr[8:16], off+8); err != nil {
+				return boxes
+			}
+			sz, hlen = int64(binary.BigEndian.Uint64(hdr[8:16])), 16
+		}
+		if sz < hlen || off+sz > end {
+			break
+		}
+		boxes = append(boxes, mp4Box{typ: string(hdr[4:8]), start: off + hlen, end: off + sz})
+		off += sz
+	}
+	return boxes
+}
+
+//mp4Find descends through the named boxes, eg mp4Find(f, 0, size, "moov", "mvhd")
+func mp4Find(f io.ReaderAt, start, end int64, path ...string) (mp4Box, bool) {
+	for _, box := range mp4Boxes(f, start, end) {
+		if box.typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return box, true
+		}
+		return mp4Find(f, box.start, box.end, path[1:]...)
+	}
+	return mp4Box{}, false
+}
+
+/*mp4Payload keeps only the mdat boxes, so moov/udta, meta, free and the like
+never contribute to the hash.*/
+func mp4Payload(f io.ReaderAt, size int64) []byteRange {
+	ranges := []byteRange{}
+	for _, box := range mp4Boxes(f, 0, size) {
+		if box.typ == "mdat" {
+			ranges = append(ranges, byteRange{box.start, box.end})
+		}
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+	return ranges
+}
@@ -0,0 +1,420 @@
+package hasher
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"io"
+)
+
+//audioProps are the stream properties read from the frame headers or container
+type audioProps struct {
+	durationMs int64
+	bitrate    int64 //kbps
+	sampleRate int64
+	channels   int64
+	codec      string
+	vbr        sql.NullBool
+}
+
+/*audioProperties fills DurationMs, Bitrate, SampleRate, Channels, Codec and
+VBR.  They are left NULL if the stream cannot be parsed.*/
+func (r *FileEntry) audioProperties(f io.ReaderAt) {
+	ranges := audioPayload(f, r.Size.Int64)
+	if ranges == nil {
+		return
+	}
+	var p *audioProps
+	if isMP4(f) {
+		p = mp4Properties(f, r.Size.Int64, ranges)
+	} else {
+		p = mp3Properties(f, ranges[0])
+	}
+	if p == nil {
+		return
+	}
+	nz := func(v int64) sql.NullInt64 { return sql.NullInt64{Int64: v, Valid: v > 0} }
+	r.DurationMs = nz(p.durationMs)
+	r.Bitrate = nz(p.bitrate)
+	r.SampleRate = nz(p.sampleRate)
+	r.Channels = nz(p.channels)
+	r.Codec = ns(p.codec)
+	r.VBR = p.vbr
+}
+
+//mpegHeader is a decoded 4 byte MPEG audio frame header
+type mpegHeader struct {
+	version    int //1, 2, or 25 for MPEG 2.5
+	layer      int
+	bitrate    int64 //kbps
+	sampleRate int64
+	padding    int64
+	mono       bool
+}
+
+var mpegBitrates = map[[2]int][]int64{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mpegSampleRates = map[int][]int64{
+	1:  {44100, 48000, 32000},
+	2:  {22050, 24000, 16000},
+	25: {11025, 12000, 8000},
+}
+
+//parseMpegHeader decodes b, returning false if it is not a usable frame header
+func parseMpegHeader(b []byte) (mpegHeader, bool) {
+	h := mpegHeader{}
+	if !isFrameSync(b) || len(b) < 4 {
+		return h, false
+	}
+	switch (b[1] >> 3) & 0x3 {
+	case 0:
+		h.version = 25
+	case 2:
+		h.version = 2
+	case 3:
+		h.version = 1
+	default:
+		return h, false
+	}
+	h.layer = 4 - int((b[1]>>1)&0x3)
+	if h.layer == 4 {
+		return h, false
+	}
+	table := h.version
+	if table == 25 {
+		table = 2
+	}
+	bri, sri := int(b[2]>>4), int((b[2]>>2)&0x3)
+	if bri == 0 || bri == 15 || sri == 3 {
+		return h, false
+	}
+	h.bitrate = mpegBitrates[[2]int{table, h.layer}][bri]
+	h.sampleRate = mpegSampleRates[h.version][sri]
+	h.padding = int64((b[2] >> 1) & 0x1)
+	h.mono = b[3]>>6 == 3
+	return h, true
+}
+
+func (h mpegHeader) samplesPerFrame() int64 {
+	switch {
+	case h.layer == 1:
+		return 384
+	case h.layer == 3 && h.version != 1:
+		return 576
+	}
+	return 1152
+}
+
+func (h mpegHeader) frameLength() int64 {
+	if h.layer == 1 {
+		return (12*h.bitrate*1000/h.sampleRate + h.padding) * 4
+	}
+	return h.samplesPerFrame()/8*h.bitrate*1000/h.sampleRate + h.padding
+}
+
+//sideInfoLength is the layer III side information size, which the Xing header follows
+func (h mpegHeader) sideInfoLength() int64 {
+	switch {
+	case h.version == 1 && h.mono:
+		return 17
+	case h.version == 1:
+		return 32
+	case h.mono:
+		return 9
+	}
+	return 17
+}
+
+/*firstFrame finds the first frame header in rg that is followed by another
+valid header, so stray sync bits in junk data are not mistaken for audio.*/
+func firstFrame(f io.ReaderAt, rg byteRange) (int64, mpegHeader, bool) {
+	const scanLimit = 64 * 1024
+	buf := make([]byte, scanLimit+4)
+	n, _ := f.ReadAt(buf, rg.start)
+	buf = buf[:n]
+	next := make([]byte, 4)
+	for i := 0; i+4 <= len(buf); i++ {
+		h, ok := parseMpegHeader(buf[i : i+4])
+		if !ok {
+			continue
+		}
+		off := rg.start + int64(i)
+		flen := h.frameLength()
+		if off+flen+4 > rg.end {
+			return off, h, true //single frame file
+		}
+		if _, err := f.ReadAt(next, off+flen); err == nil {
+			if _, ok := parseMpegHeader(next); ok {
+				return off, h, true
+			}
+		}
+	}
+	return 0, mpegHeader{}, false
+}
+
+/*mp3Properties reads the first frame header, then a Xing/Info (with LAME
+extension) or VBRI header if there is one.  Without either the stream is
+taken to be CBR and its duration is estimated from the payload size.*/
+func mp3Properties(f io.ReaderAt, rg byteRange) *audioProps {
+	off, h, ok := firstFrame(f, rg)
+	if !ok {
+		return nil
+	}
+	p := &audioProps{
+		bitrate:    h.bitrate,
+		sampleRate: h.sampleRate,
+		channels:   2,
+		codec:      []string{"", "mp1", "mp2", "mp3"}[h.layer],
+	}
+	if h.mono {
+		p.channels = 1
+	}
+
+	frame := make([]byte, h.frameLength())
+	n, _ := f.ReadAt(frame, off)
+	frame = frame[:n]
+
+	frames, bytes := int64(0), int64(0)
+	xing := 4 + h.sideInfoLength()
+	switch {
+	case h.layer == 3 && int64(len(frame)) >= xing+8 && (string(frame[xing:xing+4]) == "Xing" || string(frame[xing:xing+4]) == "Info"):
+		p.vbr = sql.NullBool{Bool: string(frame[xing:xing+4]) == "Xing", Valid: true}
+		flags := binary.BigEndian.Uint32(frame[xing+4 : xing+8])
+		pos := xing + 8
+		field := func(flag uint32, width int64) int64 {
+			if flags&flag == 0 || pos+width > int64(len(frame)) {
+				return 0
+			}
+			v := int64(0)
+			if width == 4 {
+				v = int64(binary.BigEndian.Uint32(frame[pos : pos+4]))
+			}
+			pos += width
+			return v
+		}
+		frames = field(0x1, 4)
+		bytes = field(0x2, 4)
+		field(0x4, 100) //TOC
+		field(0x8, 4)   //quality
+
+		//LAME extension; the VBR method nibble and encoder delay / padding
+		if pos+24 <= int64(len(frame)) && (string(frame[pos:pos+4]) == "LAME" || string(frame[pos:pos+4]) == "Lavf" || string(frame[pos:pos+4]) == "Lavc") {
+			switch frame[pos+9] & 0x0f {
+			case 1, 8:
+				p.vbr = sql.NullBool{Bool: false, Valid: true}
+			case 2, 3, 4, 5, 6, 9:
+				p.vbr = sql.NullBool{Bool: true, Valid: true}
+			}
+			delay := int64(frame[pos+21])<<4 | int64(frame[pos+22])>>4
+			padding := int64(frame[pos+22]&0x0f)<<8 | int64(frame[pos+23])
+			if samples := frames*h.samplesPerFrame() - delay - padding; frames > 0 && samples > 0 {
+				p.durationMs = samples * 1000 / h.sampleRate
+			}
+		}
+	case int64(len(frame)) >= 36+18 && string(frame[36:40]) == "VBRI":
+		p.vbr = sql.NullBool{Bool: true, Valid: true}
+		bytes = int64(binary.BigEndian.Uint32(frame[46:50]))
+		frames = int64(binary.BigEndian.Uint32(frame[50:54]))
+	default:
+		p.vbr = sql.NullBool{Bool: false, Valid: true}
+	}
+
+	if frames > 0 {
+		if p.durationMs == 0 {
+			p.durationMs = frames * h.samplesPerFrame() * 1000 / h.sampleRate
+		}
+		if bytes == 0 {
+			bytes = rg.end - off
+		}
+		if p.durationMs > 0 {
+			p.bitrate = bytes * 8 / p.durationMs
+		}
+		return p
+	}
+	p.durationMs = (rg.end - off) * 8 / h.bitrate
+	return p
+}
+
+/*mp4Properties reads the duration from moov/mvhd, and the codec, channels
+and sample rate from the first sound track's stsd entry.  The bitrate comes
+from its esds, or failing that from the size of the mdat payload.*/
+func mp4Properties(f io.ReaderAt, size int64, ranges []byteRange) *audioProps {
+	moov, ok := mp4Find(f, 0, size, "moov")
+	if !ok {
+		return nil
+	}
+	p := &audioProps{}
+
+	if mvhd, ok := mp4Find(f, moov.start, moov.end, "mvhd"); ok {
+		b := make([]byte, 32)
+		if n, _ := f.ReadAt(b, mvhd.start); n >= 20 {
+			var scale, duration int64
+			if b[0] == 1 && n >= 32 {
+				scale, duration = int64(binary.BigEndian.Uint32(b[20:24])), int64(binary.BigEndian.Uint64(b[24:32]))
+			} else {
+				scale, duration = int64(binary.BigEndian.Uint32(b[12:16])), int64(binary.BigEndian.Uint32(b[16:20]))
+			}
+			if scale > 0 {
+				p.durationMs = duration * 1000 / scale
+			}
+		}
+	}
+
+	if stbl, ok := mp4SoundTrack(f, moov); ok {
+		if entry, ok := mp4FirstEntry(f, stbl); ok {
+			mp4SampleEntry(f, entry, p)
+		}
+	}
+
+	if p.bitrate == 0 && p.durationMs > 0 {
+		payload := int64(0)
+		for _, rg := range ranges {
+			payload += rg.end - rg.start
+		}
+		p.bitrate = payload * 8 / p.durationMs
+	}
+	return p
+}
+
+//mp4SoundTrack returns the stbl of the first track in moov that is sound
+func mp4SoundTrack(f io.ReaderAt, moov mp4Box) (mp4Box, bool) {
+	for _, trak := range mp4Boxes(f, moov.start, moov.end) {
+		if trak.typ != "trak" {
+			continue
+		}
+		hdlr, ok := mp4Find(f, trak.start, trak.end, "mdia", "hdlr")
+		handler := make([]byte, 4)
+		if !ok {
+			continue
+		}
+		if _, err := f.ReadAt(handler, hdlr.start+8); err != nil || string(handler) != "soun" {
+			continue
+		}
+		if stbl, ok := mp4Find(f, trak.start, trak.end, "mdia", "minf", "stbl"); ok {
+			return stbl, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+//mp4FirstEntry returns the first sample entry in stbl's stsd, eg mp4a
+func mp4FirstEntry(f io.ReaderAt, stbl mp4Box) (mp4Box, bool) {
+	stsd, ok := mp4Find(f, stbl.start, stbl.end, "stsd")
+	if !ok {
+		return mp4Box{}, false
+	}
+	entries := mp4Boxes(f, stsd.start+8, stsd.end)
+	if len(entries) == 0 {
+		return mp4Box{}, false
+	}
+	return entries[0], true
+}
+
+//mp4SampleEntry decodes an AudioSampleEntry and the esds inside it
+func mp4SampleEntry(f io.ReaderAt, entry mp4Box, p *audioProps) {
+	b := make([]byte, 28)
+	if _, err := f.ReadAt(b, entry.start); err != nil {
+		return
+	}
+	p.codec = entry.typ
+	if entry.typ == "mp4a" {
+		p.codec = "aac"
+	}
+	p.channels = int64(binary.BigEndian.Uint16(b[16:18]))
+	p.sampleRate = int64(binary.BigEndian.Uint32(b[24:28]) >> 16)
+
+	d, ok := mp4Esds(f, entry)
+	if !ok {
+		return
+	}
+	objectType, maxBitrate, avgBitrate := esdsDecoderConfig(d)
+	if objectType == 0x69 || objectType == 0x6b {
+		p.codec = "mp3"
+	}
+	if avgBitrate > 0 {
+		p.bitrate = avgBitrate / 1000
+	}
+	if maxBitrate > 0 && avgBitrate > 0 {
+		p.vbr = sql.NullBool{Bool: maxBitrate > avgBitrate, Valid: true}
+	}
+}
+
+//mp4Esds returns the ES_Descriptor from the esds box of an AudioSampleEntry
+func mp4Esds(f io.ReaderAt, entry mp4Box) ([]byte, bool) {
+	b := make([]byte, 10)
+	if _, err := f.ReadAt(b, entry.start); err != nil {
+		return nil, false
+	}
+	//QuickTime sound description versions 1 and 2 carry extra fields before the child boxes
+	children := entry.start + 28
+	switch binary.BigEndian.Uint16(b[8:10]) {
+	case 1:
+		children += 16
+	case 2:
+		children += 36
+	}
+	esds, ok := mp4Find(f, children, entry.end, "esds")
+	if !ok {
+		return nil, false
+	}
+	d := make([]byte, esds.end-esds.start)
+	if _, err := f.ReadAt(d, esds.start); err != nil || len(d) < 4 {
+		return nil, false
+	}
+	return d[4:], true
+}
+
+/*esdsDecoderConfig walks the ES_Descriptor in d for its DecoderConfigDescriptor,
+returning the object type and the max and average bitrates in bits per second.*/
+func esdsDecoderConfig(d []byte) (objectType byte, maxBitrate, avgBitrate int64) {
+	//descriptor returns the tag, and the payload following its variable length size
+	descriptor := func(d []byte) (byte, []byte) {
+		if len(d) < 2 {
+			return 0, nil
+		}
+		size, i := 0, 1
+		for ; i < len(d) && i < 5; i++ {
+			size = size<<7 | int(d[i]&0x7f)
+			if d[i]&0x80 == 0 {
+				break
+			}
+		}
+		i++
+		if i+size > len(d) {
+			size = len(d) - i
+		}
+		if size < 0 {
+			return 0, nil
+		}
+		return d[0], d[i : i+size]
+	}
+
+	tag, es := descriptor(d)
+	if tag != 0x03 || len(es) < 3 {
+		return
+	}
+	flags, pos := es[2], 3
+	if flags&0x80 != 0 {
+		pos += 2
+	}
+	if flags&0x40 != 0 && pos < len(es) {
+		pos += 1 + int(es[pos])
+	}
+	if flags&0x20 != 0 {
+		pos += 2
+	}
+	if pos >= len(es) {
+		return
+	}
+	tag, dc := descriptor(es[pos:])
+	if tag != 0x04 || len(dc) < 13 {
+		return
+	}
+	return dc[0], int64(binary.BigEndian.Uint32(dc[5:9])), int64(binary.BigEndian.Uint32(dc[9:13]))
+}
@@ -0,0 +1,163 @@
+package hasher
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//DefaultFlushInterval is the longest assemble holds scanned files before writing them, unless told otherwise
+const DefaultFlushInterval = 500 * time.Millisecond
+
+//SetFlushInterval sets the longest assemble holds scanned files before writing them, however few there are
+func (fdb *FileDB) SetFlushInterval(d time.Duration) {
+	if d <= 0 {
+		d = DefaultFlushInterval
+	}
+	fdb.flushEvery = d
+}
+
+/*InsertBatch inserts records in a single transaction, through one prepared
+statement.  Either all of them are inserted or none are.*/
+func (fdb *FileDB) InsertBatch(records []*FileEntry) error {
+	if len(records) == 0 {
+		return nil
+	}
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+
+	tx, err := fdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareNamed(records[0].insertStmt())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range records {
+		if _, err := stmt.Exec(r); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//scanned is a freshly read file on its way to the database, with the row it replaces if any
+type scanned struct {
+	entry *FileEntry
+	prev  knownFile
+}
+
+/*batchWriter stores scanned files for PopulateDB.  Its statements are prepared
+once, and rows are committed together every size files or every interval,
+whichever comes first.*/
+type batchWriter struct {
+	fdb            *FileDB
+	insert, update *sqlx.NamedStmt
+	size           int
+	every          time.Duration
+	pending        []scanned
+}
+
+func (fdb *FileDB) newBatchWriter(size int, every time.Duration) (*batchWriter, error) {
+	w := &batchWriter{fdb: fdb, size: size, every: every, pending: make([]scanned, 0, size)}
+	r := &FileEntry{}
+	var err error
+	if w.insert, err = fdb.db.PrepareNamed(r.insertStmt()); err != nil {
+		return nil, err
+	}
+	if w.update, err = fdb.db.PrepareNamed(r.updateStmt()); err != nil {
+		w.insert.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+//Close releases the prepared statements
+func (w *batchWriter) Close() error {
+	w.update.Close()
+	return w.insert.Close()
+}
+
+//run stores everything sent on in, then flushes what is left once it is closed
+func (w *batchWriter) run(in <-chan scanned) {
+	tick := time.NewTicker(w.every)
+	defer tick.Stop()
+	for {
+		select {
+		case s, ok := <-in:
+			if !ok {
+				w.flush()
+				return
+			}
+			w.pending = append(w.pending, s)
+			if len(w.pending) >= w.size {
+				w.flush()
+			}
+		case <-tick.C:
+			w.flush()
+		}
+	}
+}
+
+/*flush writes the pending files in a single transaction: new files are
+inserted, and changed ones update their row, or replace it if it lives in a
+table other than scanned_files.  If the transaction fails it is retried one
+file at a time, so only the files that cannot be stored end up in scan_errors.*/
+func (w *batchWriter) flush() {
+	if len(w.pending) == 0 {
+		return
+	}
+	if err := w.write(w.pending); err == nil {
+		for _, s := range w.pending {
+			log.Printf("✓: %s\n", s.entry.Path.String)
+		}
+	} else {
+		for _, s := range w.pending {
+			if err := w.write([]scanned{s}); err != nil {
+				w.fdb.scanError(s.entry.Path.String, stageStore, err)
+				continue
+			}
+			log.Printf("✓: %s\n", s.entry.Path.String)
+		}
+	}
+	w.pending = w.pending[:0]
+}
+
+func (w *batchWriter) write(batch []scanned) error {
+	w.fdb.mutex.Lock()
+	defer w.fdb.mutex.Unlock()
+	tx, err := w.fdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	insert, update := tx.NamedStmt(w.insert), tx.NamedStmt(w.update)
+	for _, s := range batch {
+		if err := w.store(tx, insert, update, s); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (w *batchWriter) store(tx *sqlx.Tx, insert, update *sqlx.NamedStmt, s scanned) error {
+	switch {
+	case s.prev.FileEntry == nil:
+	case s.prev.table == "scanned_files":
+		s.entry.ID = s.prev.ID
+		_, err := update.Exec(s.entry)
+		return err
+	default:
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE id=?`, s.prev.table), s.prev.ID.Int64); err != nil {
+			return err
+		}
+	}
+	_, err := insert.Exec(s.entry)
+	return err
+}
@@ -0,0 +1,268 @@
+package hasher
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//What move does when something already exists at a file's destination
+const (
+	ConflictSkip              = "skip"                //leave the file where it is
+	ConflictSuffix            = "suffix"              //move it beside the existing file as "<name> (N)<ext>"
+	ConflictOverwriteIfBetter = "overwrite-if-better" //move the existing file aside and take its place if this one is better quality
+	ConflictCompare           = "compare"             //record it as a duplicate if the existing file is identical
+)
+
+//ConflictPolicies lists the accepted --on-conflict values
+var ConflictPolicies = []string{ConflictSkip, ConflictSuffix, ConflictOverwriteIfBetter, ConflictCompare}
+
+//Exists is returned by Destination when something is already at the destination path
+type Exists struct {
+	Path string
+}
+
+func (e Exists) Error() string {
+	return fmt.Sprintf("Remote Path Exists!!! %s", e.Path)
+}
+
+//qualityPolicy decides overwrite-if-better
+var qualityPolicy = &Policy{Rules: []Rule{{Prefer: "lossless"}, {Prefer: "bitrate"}, {Prefer: "sample_rate"}}}
+
+func moveConflictsCreateStmt() string {
+	return `CREATE TABLE IF NOT EXISTS move_conflicts (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, op_id INTEGER, file_id INTEGER, source TEXT, destination TEXT, policy TEXT, outcome TEXT, moved_to TEXT, created_at INTEGER)`
+}
+
+//SetConflictPolicy sets what move does when a destination is taken; one of ConflictPolicies
+func (fdb *FileDB) SetConflictPolicy(policy string) error {
+	for _, p := range ConflictPolicies {
+		if p == policy {
+			fdb.onConflict = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict policy %q", policy)
+}
+
+func (fdb *FileDB) recordConflict(op int64, r *FileEntry, dest, outcome, movedTo string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	_, err := fdb.db.Exec(`INSERT INTO move_conflicts (op_id, file_id, source, destination, policy, outcome, moved_to, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		op, r.ID.Int64, r.Path.String, dest, fdb.onConflict, outcome, movedTo, time.Now().Unix())
+	return err
+}
+
+//freeSuffix returns the first "<name> (N)<ext>" beside dest that does not exist
+func freeSuffix(dest string) string {
+	ext := filepath.Ext(dest)
+	base := strings.TrimSuffix(dest, ext)
+	for n := 1; ; n++ {
+		p := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return p
+		}
+	}
+}
+
+/*keeperOf returns the id of the row for existing, the file at path: the row a
+move put there, or a scanned row at that path.  If there is neither, it is a
+file that was already in the library, so existing is recorded in moved, where
+files in the library are kept, and that is journaled under op as "adopt".*/
+func (fdb *FileDB) keeperOf(op int64, path string, existing *FileEntry) (int64, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	id := int64(0)
+	if err := fdb.db.Get(&id, `SELECT file_id FROM operations WHERE kind IN ('move', 'adopt') AND destination = ? AND status IN ('done', 'copied') AND file_id IN (SELECT id FROM moved) ORDER BY id DESC LIMIT 1`, path); err == nil {
+		return id, nil
+	}
+	if err := fdb.db.Get(&id, `SELECT id FROM scanned_files WHERE path = ?`, path); err == nil {
+		return id, nil
+	}
+
+	tx, err := fdb.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.NamedExec(existing.insertStmt(), existing)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if id, err = res.LastInsertId(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, stmt := range []string{
+		`INSERT INTO moved (` + columnList(true) + `) SELECT ` + columnList(true) + ` FROM scanned_files WHERE id = ?`,
+		`DELETE FROM scanned_files WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO operations (op_id, kind, created_at, file_id, source, destination, status) VALUES (?, 'adopt', ?, ?, '', ?, 'done')`,
+		op, time.Now().Unix(), id, path); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+/*resolveConflict applies the conflict policy to r, whose destination dest is
+taken.  It returns where r should be moved to, or "" if it should stay put,
+and records the outcome in move_conflicts either way.*/
+func (fdb *FileDB) resolveConflict(op int64, r *FileEntry, dest string) (string, error) {
+	outcome, moveTo := "skipped", ""
+	switch fdb.onConflict {
+	case ConflictSuffix:
+		outcome, moveTo = "suffixed", freeSuffix(dest)
+	case ConflictCompare:
+		existing, err := NewFileEntry(dest)
+		if err != nil {
+			outcome = "unreadable"
+			break
+		}
+		if !r.XxHash.Valid {
+			//assemble only hashes files in full when they might be duplicates
+			if h, err := hashFile(r.Path.String); err == nil {
+				r.XxHash = ns(h)
+			}
+		}
+		if existing.XxHash.String != r.XxHash.String {
+			outcome = "differs"
+			break
+		}
+		outcome = "duplicate"
+		keeper, err := fdb.keeperOf(op, dest, existing)
+		if err != nil {
+			return "", err
+		}
+		fdb.mutex.Lock()
+		tx := fdb.db.MustBegin()
+		tx.MustExec(`INSERT INTO duplicates (`+columnList(true)+`, duplicate_of) SELECT `+columnList(true)+`, ? FROM scanned_files WHERE id = ?`, strconv.FormatInt(keeper, 10), r.ID.Int64)
+		members := []dupMember{
+			{FileID: r.ID, Role: ns(roleToss), DecidedBy: ns(decidedAuto)},
+			{FileID: sql.NullInt64{Int64: keeper, Valid: true}, Role: ns(roleKeep), DecidedBy: ns(decidedAuto)},
+		}
+		if _, err := insertGroup(tx, byMoveConflict, "same bytes as "+dest, 1, members); err != nil {
+			tx.Rollback()
+			fdb.mutex.Unlock()
+			return "", err
+		}
+		tx.MustExec(`DELETE FROM scanned_files WHERE id = ?`, r.ID.Int64)
+		err = tx.Commit()
+		fdb.mutex.Unlock()
+		if err != nil {
+			return "", err
+		}
+	case ConflictOverwriteIfBetter:
+		existing, err := NewFileEntry(dest)
+		if err != nil {
+			outcome = "unreadable"
+			break
+		}
+		if best := qualityPolicy.Rank(Duplicates{r, existing}); len(best) == 1 && best[0] == r {
+			aside, err := fdb.displace(op, r, dest, existing)
+			if err != nil {
+				return "", err
+			}
+			fmt.Printf("* [conflict] moved %s aside to %s\n", dest, aside)
+			outcome, moveTo = "overwrote", dest
+		} else {
+			outcome = "kept-existing"
+		}
+	}
+	fmt.Printf("* [conflict] %s -> %s: %s\n", r.Path.String, dest, outcome)
+	return moveTo, fdb.recordConflict(op, r, dest, outcome, moveTo)
+}
+
+//replacedPath returns where a file displaced from dest is kept; "<name>.replaced<ext>", or "<name>.replaced (N)<ext>" if that is taken
+func replacedPath(dest string) string {
+	ext := filepath.Ext(dest)
+	aside := strings.TrimSuffix(dest, ext) + ".replaced" + ext
+	if _, err := os.Stat(aside); os.IsNotExist(err) {
+		return aside
+	}
+	return freeSuffix(aside)
+}
+
+//replacedRule is the rule a file displaced from dest is recorded as a duplicate under
+func replacedRule(dest string) string {
+	return "replaced by a better file at " + dest
+}
+
+/*libraryTable is the table the row for the file at path lives in, and the
+path the row gives: moved, and where it was moved from, if a move put it
+there; moved and path if it was adopted by keeperOf; otherwise scanned_files
+and path.*/
+func libraryTable(q sqlx.Queryer, id int64, path string) (string, string) {
+	op := journalEntry{}
+	if err := sqlx.Get(q, &op, `SELECT kind, source FROM operations WHERE kind IN ('move', 'adopt') AND file_id = ? AND destination = ? AND status IN ('done', 'copied') ORDER BY id DESC LIMIT 1`, id, path); err != nil {
+		return "scanned_files", path
+	}
+	if op.Kind.String == "adopt" {
+		return "moved", path
+	}
+	return "moved", op.Source.String
+}
+
+/*displace moves existing, the file at dest, aside to replacedPath, so r can
+be moved over it without destroying it, returning where it went.  The move
+is journaled under op, so Undo puts it back, and the row for the file is
+moved into duplicates as a duplicate of r.*/
+func (fdb *FileDB) displace(op int64, r *FileEntry, dest string, existing *FileEntry) (string, error) {
+	aside := replacedPath(dest)
+	id, err := fdb.keeperOf(op, dest, existing)
+	if err != nil {
+		return "", err
+	}
+	entry, err := fdb.journal(op, "replace", id, dest, aside, "pending")
+	if err != nil {
+		return "", err
+	}
+	if _, err := moveFile(dest, aside, ""); err != nil {
+		fdb.setJournalStatus(entry, "failed")
+		return "", err
+	}
+
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	tx, err := fdb.db.Beginx()
+	if err != nil {
+		return "", err
+	}
+	table, _ := libraryTable(tx, id, dest)
+	members := []dupMember{
+		{FileID: r.ID, Role: ns(roleKeep), DecidedBy: ns(decidedAuto)},
+		{FileID: sql.NullInt64{Int64: id, Valid: true}, Role: ns(roleToss), DecidedBy: ns(decidedAuto)},
+	}
+	for _, stmt := range []string{
+		`INSERT INTO duplicates (` + columnList(true) + `, duplicate_of) SELECT ` + columnList(true) + `, ` + strconv.FormatInt(r.ID.Int64, 10) + ` FROM ` + table + ` WHERE id = ?`,
+		`DELETE FROM ` + table + ` WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE duplicates SET path = ? WHERE id = ?`, aside, id); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if _, err := insertGroup(tx, byMoveConflict, replacedRule(dest), 1, members); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE operations SET status = 'done' WHERE id = ?`, entry); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return aside, tx.Commit()
+}
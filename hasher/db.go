@@ -1,10 +1,13 @@
 package hasher
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3" // Import go-sqlite3 library
@@ -13,12 +16,13 @@ import (
 //CreateFileDB creates or opens an old BD
 func CreateFileDB(path string) *FileDB {
 	log.Printf("Creating / Opening %s\n", path)
-	db, err := sqlx.Open("sqlite3", path)
+	//WAL with synchronous=NORMAL only syncs at checkpoints rather than on every commit
+	db, err := sqlx.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=NORMAL")
 	if err != nil {
 		panic(err)
 	}
 
-	rtn := &FileDB{db: db, mutex: &sync.RWMutex{}}
+	rtn := &FileDB{db: db, mutex: &sync.RWMutex{}, onConflict: ConflictSkip, batchSize: DefaultBatchSize, flushEvery: DefaultFlushInterval, fuzzyAt: DefaultFuzzyThreshold, durationTolerance: DefaultDurationTolerance}
 
 	if err := rtn.createSchema(); err != nil {
 		panic(err)
@@ -29,8 +33,25 @@ func CreateFileDB(path string) *FileDB {
 
 /*FileDB is a wrapper over a SQL database*/
 type FileDB struct {
-	db    *sqlx.DB
-	mutex *sync.RWMutex
+	db         *sqlx.DB
+	mutex      *sync.RWMutex
+	policy     *Policy
+	namer      *Namer
+	onConflict string
+	batchSize  int
+	flushEvery time.Duration
+	fullHash   bool
+	dryRun     bool
+	unattended bool
+
+	fingerprintAt    float64
+	fingerprintProcs int
+	fuzzyAt          float64
+
+	durationTolerance time.Duration
+	resume            bool
+	resuming          string
+	reviewStarted     int64
 }
 
 //Close closes the db
@@ -38,6 +59,32 @@ func (fdb *FileDB) Close() error {
 	return fdb.db.Close()
 }
 
+//DefaultBatchSize is how many scanned files assemble writes per transaction unless told otherwise
+const DefaultBatchSize = 500
+
+//SetBatchSize sets how many scanned files assemble writes per transaction
+func (fdb *FileDB) SetBatchSize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	fdb.batchSize = n
+}
+
+//UsePolicy has analyze pick which duplicate to keep with p, only prompting on ties
+func (fdb *FileDB) UsePolicy(p *Policy) {
+	fdb.policy = p
+}
+
+//UseFormat has move lay files out with the NewNamer template format, with names made safe for the filesystem profile
+func (fdb *FileDB) UseFormat(format, profile string) error {
+	namer, err := NewNamer(format, profile)
+	if err != nil {
+		return err
+	}
+	fdb.namer = namer
+	return nil
+}
+
 /*Exec arbitrary SQL*/
 func (fdb *FileDB) Exec(stmt string) (sql.Result, error) {
 	fdb.mutex.Lock()
@@ -51,32 +98,98 @@ func (fdb *FileDB) Exec(stmt string) (sql.Result, error) {
 
 func (fdb *FileDB) createSchema() error {
 	r := FileEntry{}
+	q := quarantinedFile{}
+	j := journalEntry{}
+	v := verifiedCopy{}
+	s := sidecar{}
+	p := prunedDir{}
+	l := linkedFile{}
+	rl := reflinkedFile{}
+	se := scanError{}
+	fc := fuzzyCandidate{}
+	dv := differentVersion{}
+	dg := dupGroup{}
+	dm := dupMember{}
+	rs := reviewSession{}
 	schemas := []string{
 		r.createStmt(),
+		q.createStmt(),
+		j.createStmt(),
+		v.createStmt(),
+		s.createStmt(),
+		p.createStmt(),
+		l.createStmt(),
+		rl.createStmt(),
+		se.createStmt(),
+		fc.createStmt(),
+		dv.createStmt(),
+		dg.createStmt(),
+		dm.createStmt(),
+		rs.createStmt(),
+		scanRootsCreateStmt(),
+		moveConflictsCreateStmt(),
 		`CREATE TABLE IF NOT EXISTS rejects AS SELECT ' ' as reason, * FROM scanned_files LIMIT 0`,
 		`CREATE TABLE IF NOT EXISTS duplicates AS SELECT *, ' ' as duplicate_of FROM scanned_files LIMIT 0`,
 		`CREATE TABLE IF NOT EXISTS moved AS SELECT * FROM scanned_files LIMIT 0`,
+		`CREATE TABLE IF NOT EXISTS missing_tags AS SELECT * FROM scanned_files LIMIT 0`,
+		`CREATE TABLE IF NOT EXISTS removed AS SELECT * FROM scanned_files LIMIT 0`,
 	}
 	for _, stmt := range schemas {
 		if _, err := fdb.Exec(stmt); err != nil {
 			return err
 		}
 	}
+	return fdb.migrate()
+}
+
+//fileTables are scanned_files and all the tables holding copies of its rows
+var fileTables = []string{"scanned_files", "rejects", "duplicates", "moved", "missing_tags", "removed"}
+
+/*migrate appends any columns missing from databases created by older versions*/
+func (fdb *FileDB) migrate() error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	for _, table := range fileTables {
+		have := map[string]bool{}
+		rows, err := fdb.db.Queryx(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			col := map[string]interface{}{}
+			if err := rows.MapScan(col); err != nil {
+				rows.Close()
+				return err
+			}
+			have[fmt.Sprintf("%s", col["name"])] = true
+		}
+		rows.Close()
+
+		for _, c := range columns {
+			if have[c.name] {
+				continue
+			}
+			log.Printf("Adding column %s to %s\n", c.name, table)
+			if _, err := fdb.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, c.name, c.decl)); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 /*Insert a record*/
 func (fdb *FileDB) Insert(record *FileEntry) error {
+	return fdb.InsertBatch([]*FileEntry{record})
+}
+
+/*Update rewrites the record with the same id*/
+func (fdb *FileDB) Update(record *FileEntry) error {
 	fdb.mutex.Lock()
 	defer fdb.mutex.Unlock()
 
-	tx := fdb.db.MustBegin()
-	stmt, err := tx.PrepareNamed(record.insertStmt())
-	if err != nil {
-		panic(err)
-	}
-	stmt.MustExec(record)
-	return tx.Commit()
+	_, err := fdb.db.NamedExec(record.updateStmt(), record)
+	return err
 }
 
 //MustExecMany simply blindly executes many sequential SQL strings
@@ -97,24 +210,38 @@ func (fdb *FileDB) WithDb(fxn func(*sqlx.DB)) {
 	fxn(fdb.db)
 }
 
-/*Keep adds */
+/*Keep adds dups to duplicates, with keep's id in duplicate_of*/
 func (fdb *FileDB) Keep(keep *FileEntry, dups Duplicates) error {
-	dupStmt := fmt.Sprintf(`INSERT INTO duplicates SELECT *, %d as reason from scanned_files where id = ?`, keep.ID.Int64)
 	tx := fdb.db.MustBegin()
-
-	if len(dups) == 0 {
-		return tx.Commit()
-	}
-
-	for _, id := range dups {
-		tx.MustExec(dupStmt, id.ID.Int64)
+	if err := keepIn(tx, keep, dups); err != nil {
+		tx.Rollback()
+		return err
 	}
 	return tx.Commit()
 }
 
-/*DupNuker removes all files located in the duplicate column.*/
-func (fdb *FileDB) DupNuker() error {
-	dstmt := `SELECT path FROM duplicates`
+//unlinked picks out the duplicates that dup-link and dup-reflink have not already dealt with by keeping them as links
+const unlinked = `id NOT IN (SELECT file_id FROM linked) AND id NOT IN (SELECT file_id FROM reflinked)`
+
+/*DupNuker removes all files located in the duplicate column.  If quarantine is
+not empty, they are moved under it instead so they can be restored.  It stops
+between files if ctx is cancelled; files already gone are passed over next time.
+
+Duplicates replaced by links with DupLinker or DupReflinker are left alone, as
+they were kept so whatever points at them still finds the track.*/
+func (fdb *FileDB) DupNuker(ctx context.Context, quarantine string) error {
+	if quarantine != "" {
+		return fdb.quarantineDups(ctx, quarantine)
+	}
+	if fdb.dryRun {
+		dups := []*FileEntry{}
+		fdb.WithDb(func(db *sqlx.DB) { db.Select(&dups, `SELECT id, path FROM duplicates WHERE `+unlinked) })
+		for _, dup := range dups {
+			fmt.Printf("* [dry-run] would remove %s\n", dup.Path.String)
+		}
+		return nil
+	}
+	dstmt := `SELECT path FROM duplicates WHERE ` + unlinked
 	tx := fdb.db.MustBegin()
 	rows, err := tx.Queryx(dstmt)
 	if err != nil {
@@ -122,6 +249,9 @@ func (fdb *FileDB) DupNuker() error {
 	}
 	defer rows.Close()
 	for rows.Next() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		res := &FileEntry{}
 		for _, fxn := range []func() error{
 			func() error { return rows.StructScan(res) },
@@ -138,36 +268,90 @@ func (fdb *FileDB) DupNuker() error {
 /*RenameInto moves files from the source locations into <root>.
 
 Generally, these get shoved in <root>/<artist>/<album>/<track> - <title>.<ext>
+
+Cover art, lyrics and the like follow their tracks; see moveSidecars.
+
+Every move, and every directory created for one, is journaled in operations
+before it happens so the whole run can be reversed with Undo.
+
+If ctx is cancelled it stops between files, records what has moved so far and
+returns ctx's error.  Running it again moves the rest.
 */
-func (fdb *FileDB) RenameInto(root string) error {
-	rename := func() []int64 {
+func (fdb *FileDB) RenameInto(ctx context.Context, root string) error {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	files := []*FileEntry{}
+	moved := map[int64]string{}
+	rename := func(op int64) []int64 {
 		ids := []int64{}
 
 		fdb.mutex.Lock()
-		defer fdb.mutex.Unlock()
-
-		tx := fdb.db.MustBegin()
-		cur, err := tx.Queryx(`SELECT * from scanned_files`)
+		err := fdb.db.Select(&files, `SELECT * from scanned_files`)
+		fdb.mutex.Unlock()
 		if err != nil {
 			panic(err)
 		}
-		defer cur.Close()
-		for cur.Next() {
-			res := &FileEntry{}
-			if err := cur.StructScan(res); err != nil {
+
+		for _, res := range files {
+			if ctx.Err() != nil {
+				break
+			}
+			dest, err := res.Destination(root, fdb.namer)
+			switch err.(type) {
+			case nil:
+			case Exists:
+				if fdb.dryRun {
+					fmt.Printf("* [dry-run] %s exists; would apply --on-conflict=%s to %s\n", dest, fdb.onConflict, res.Path.String)
+					continue
+				}
+				if dest, err = fdb.resolveConflict(op, res, dest); err != nil {
+					panic(err)
+				}
+				if dest == "" {
+					continue
+				}
+			default:
+				continue
+			}
+			if fdb.dryRun {
+				fmt.Printf("* [dry-run] would move %s -> %s\n", res.Path.String, dest)
+				moved[res.ID.Int64] = dest
+				continue
+			}
+
+			for _, dir := range missingDirs(dest) {
+				if _, err := fdb.journal(op, "mkdir", res.ID.Int64, "", dir, "done"); err != nil {
+					panic(err)
+				}
+			}
+			entry, err := fdb.journal(op, "move", res.ID.Int64, res.Path.String, dest, "pending")
+			if err != nil {
 				panic(err)
 			}
 
-			err := res.Rename(root)
+			copied, err := res.MoveTo(dest)
+			status := "done"
 			switch err.(type) {
 			case nil:
 				ids = append(ids, res.ID.Int64)
+				moved[res.ID.Int64] = dest
+				if copied {
+					status = "copied"
+					if err := fdb.recordCopy(op, res, dest); err != nil {
+						panic(err)
+					}
+				}
 			case Skipped:
+				status = "skipped"
 			default:
+				fdb.setJournalStatus(entry, "failed")
+				panic(err)
+			}
+			if err := fdb.setJournalStatus(entry, status); err != nil {
 				panic(err)
 			}
 		}
-		tx.Commit()
 		return ids
 	}
 
@@ -176,14 +360,25 @@ func (fdb *FileDB) RenameInto(root string) error {
 		defer fdb.mutex.Unlock()
 		tx := fdb.db.MustBegin()
 		for _, id := range ids {
-			tx.MustExec(`INSERT INTO moved SELECT * FROM scanned_files WHERE id=?`, id)
+			tx.MustExec(`INSERT INTO moved (`+columnList(true)+`) SELECT `+columnList(true)+` FROM scanned_files WHERE id=?`, id)
 		}
 		tx.Commit()
 	}
-	ids := rename()
+	op, err := fdb.nextOperation()
+	if err != nil {
+		return err
+	}
+	ids := rename(op)
+	if err := fdb.moveSidecars(op, files, moved); err != nil {
+		return err
+	}
+	if fdb.dryRun {
+		return nil
+	}
 	markMoved(ids)
+	log.Printf("Moved %d files as operation %d; reverse it with: undo --op %d\n", len(ids), op, op)
 
 	fdb.MustExecMany([]string{`DELETE FROM scanned_files WHERE id IN (SELECT id FROM moved)`})
 
-	return nil
+	return ctx.Err()
 }
@@ -0,0 +1,95 @@
+package hasher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//SetDryRun has the mutating operations report what they would do without touching files or committing to the database
+func (fdb *FileDB) SetDryRun(on bool) {
+	fdb.dryRun = on
+}
+
+/*scratchCopy snapshots the database into a temporary file that a dry run
+can freely change.  Call the returned func to throw it away.*/
+func (fdb *FileDB) scratchCopy() (*FileDB, func(), error) {
+	dir, err := ioutil.TempDir("", "music-hasher")
+	if err != nil {
+		return nil, nil, err
+	}
+	path := filepath.Join(dir, "dry-run.db")
+	if _, err := fdb.Exec(`VACUUM INTO '` + strings.Replace(path, "'", "''", -1) + `'`); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	scratch := CreateFileDB(path)
+	scratch.policy = fdb.policy
+	scratch.fingerprintAt, scratch.fingerprintProcs = fdb.fingerprintAt, fdb.fingerprintProcs
+	scratch.fuzzyAt, scratch.durationTolerance = fdb.fuzzyAt, fdb.durationTolerance
+	scratch.unattended = true
+	return scratch, func() {
+		scratch.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+/*dryRunPrune runs Prune against a scratch copy, then reports the rows it
+would have added to duplicates and dropped from scanned_files.*/
+func (fdb *FileDB) dryRunPrune(ctx context.Context) error {
+	scratch, cleanup, err := fdb.scratchCopy()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := scratch.Prune(ctx); err != nil {
+		return err
+	}
+
+	type row struct {
+		ID          int64  `db:"id"`
+		Path        string `db:"path"`
+		DuplicateOf string `db:"duplicate_of"`
+	}
+	load := func(f *FileDB, stmt string) (map[int64]row, error) {
+		rows := []row{}
+		f.mutex.Lock()
+		err := f.db.Select(&rows, stmt)
+		f.mutex.Unlock()
+		m := map[int64]row{}
+		for _, r := range rows {
+			m[r.ID] = r
+		}
+		return m, err
+	}
+
+	for _, table := range []struct{ name, stmt string }{
+		{"duplicates", `SELECT id, path, duplicate_of FROM duplicates`},
+		{"scanned_files", `SELECT id, path, '' AS duplicate_of FROM scanned_files`},
+	} {
+		before, err := load(fdb, table.stmt)
+		if err != nil {
+			return err
+		}
+		after, err := load(scratch, table.stmt)
+		if err != nil {
+			return err
+		}
+		for id, r := range after {
+			if _, ok := before[id]; !ok {
+				fmt.Printf("* [dry-run] would add to %s: %s (duplicate of %s)\n", table.name, r.Path, r.DuplicateOf)
+			}
+		}
+		for id, r := range before {
+			if _, ok := after[id]; !ok {
+				fmt.Printf("* [dry-run] would delete from %s: %s\n", table.name, r.Path)
+			}
+		}
+	}
+	return nil
+}
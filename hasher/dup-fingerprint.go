@@ -0,0 +1,276 @@
+package hasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//DefaultFingerprintThreshold is how alike two fingerprints must be for analyze to call them the same recording, unless told otherwise
+const DefaultFingerprintThreshold = 0.85
+
+/*UseFingerprints has analyze fingerprint the audio of each file, goroutines
+at a time, and group files whose fingerprints are at least threshold alike.
+This finds the same recording in different encodings, which no hash can.*/
+func (fdb *FileDB) UseFingerprints(threshold float64, goroutines int) {
+	if goroutines < 1 {
+		goroutines = 1
+	}
+	fdb.fingerprintAt = threshold
+	fdb.fingerprintProcs = goroutines
+}
+
+//fingerprintBatch is how many fingerprints are written per transaction, so an interrupted run keeps most of its work
+const fingerprintBatch = 50
+
+/*fingerprintMissing fingerprints the rows in scanned_files that have none.
+Rows whose codec there is no decoder for, or that fail to decode, get an
+empty fingerprint, so they are not tried again; files that cannot be read are
+left for the next run.*/
+func (fdb *FileDB) fingerprintMissing(ctx context.Context) error {
+	todo := []*FileEntry{}
+	fdb.mutex.Lock()
+	err := fdb.db.Select(&todo, `SELECT id, path, codec FROM scanned_files WHERE fingerprint IS NULL`)
+	fdb.mutex.Unlock()
+	if err != nil || len(todo) == 0 {
+		return err
+	}
+	log.Printf("Fingerprinting %d files\n", len(todo))
+
+	//run is cancelled if storing fails, so the goroutines below stop too
+	run, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type printed struct {
+		id int64
+		fp string
+	}
+	work := make(chan *FileEntry)
+	done := make(chan printed, fingerprintBatch)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < fdb.fingerprintProcs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				pcm, err := decodePCM(r.Path.String, r.Codec.String)
+				var unreadable *os.PathError
+				switch {
+				case errors.Is(err, errNoDecoder):
+					done <- printed{r.ID.Int64, ""}
+				case err != nil:
+					fdb.scanError(r.Path.String, stageRead, err)
+					if !errors.As(err, &unreadable) {
+						done <- printed{r.ID.Int64, ""} //it will not decode next time either
+					}
+				default:
+					done <- printed{r.ID.Int64, encodeFingerprint(fingerprintPCM(pcm))}
+				}
+			}
+		}()
+	}
+	go func() {
+	feed:
+		for _, r := range todo {
+			select {
+			case work <- r:
+			case <-run.Done():
+				break feed
+			}
+		}
+		close(work)
+		wg.Wait()
+		close(done)
+	}()
+
+	store := func(batch []printed) error {
+		fdb.mutex.Lock()
+		defer fdb.mutex.Unlock()
+		tx, err := fdb.db.Beginx()
+		if err != nil {
+			return err
+		}
+		for _, p := range batch {
+			if _, err := tx.Exec(`UPDATE scanned_files SET fingerprint = ? WHERE id = ?`, p.fp, p.id); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+	//fail stops the goroutines and waits for them, so none are left blocked sending
+	fail := func(err error) error {
+		cancel()
+		for range done {
+		}
+		return err
+	}
+	batch := []printed{}
+	for p := range done {
+		if batch = append(batch, p); len(batch) >= fingerprintBatch {
+			if err := store(batch); err != nil {
+				return fail(err)
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := store(batch); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+//fingerprintSlack is how far apart in length, in ms, two files may be and still be compared by fingerprint
+func fingerprintSlack(ms int64) int64 {
+	if ms/20 > 5000 {
+		return ms / 20
+	}
+	return 5000
+}
+
+//fingerprintCluster is the ids of rows that sound alike, and the similarity of the least alike pair that joined them
+type fingerprintCluster struct {
+	ids   []int64
+	score float64
+}
+
+/*fingerprintClusters groups the ids of rows whose fingerprints are at least
+threshold alike, directly or through other rows.  Only files of about the
+same length are compared.*/
+func (fdb *FileDB) fingerprintClusters(ctx context.Context) ([]fingerprintCluster, error) {
+	rows := []*FileEntry{}
+	fdb.mutex.Lock()
+	err := fdb.db.Select(&rows, `SELECT id, duration_ms, fingerprint FROM scanned_files
+		WHERE fingerprint IS NOT NULL AND fingerprint != '' AND duration_ms IS NOT NULL ORDER BY duration_ms`)
+	fdb.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	prints := make([][]uint32, len(rows))
+	for i, r := range rows {
+		prints[i] = decodeFingerprint(r.Fingerprint.String)
+	}
+
+	type pair struct {
+		a, b  int
+		score float64
+	}
+	work := make(chan int)
+	matches := make(chan pair)
+	wg := &sync.WaitGroup{}
+	for g := 0; g < fdb.fingerprintProcs; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				limit := rows[i].DurationMs.Int64 + fingerprintSlack(rows[i].DurationMs.Int64)
+				for j := i + 1; j < len(rows) && rows[j].DurationMs.Int64 <= limit; j++ {
+					if s := fingerprintSimilarity(prints[i], prints[j]); s >= fdb.fingerprintAt {
+						matches <- pair{i, j, s}
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		for i := range rows {
+			if ctx.Err() != nil {
+				break
+			}
+			work <- i
+		}
+		close(work)
+		wg.Wait()
+		close(matches)
+	}()
+
+	parent := make([]int, len(rows))
+	score := make([]float64, len(rows)) //lowest score joining each root's cluster
+	for i := range parent {
+		parent[i], score[i] = i, 1
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for m := range matches {
+		ra, rb := find(m.a), find(m.b)
+		if ra != rb {
+			parent[ra] = rb
+			score[rb] = minFloat(score[rb], score[ra])
+		}
+		score[rb] = minFloat(score[rb], m.score)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	byRoot := map[int][]int64{}
+	for i, r := range rows {
+		byRoot[find(i)] = append(byRoot[find(i)], r.ID.Int64)
+	}
+	clusters := []fingerprintCluster{}
+	for root, ids := range byRoot {
+		if len(ids) > 1 {
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			clusters = append(clusters, fingerprintCluster{ids, score[root]})
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].ids[0] < clusters[j].ids[0] })
+	return clusters, nil
+}
+
+/*resolveFingerprintDups resolves files that sound the same, whatever their
+encoding, by clustering them on their acoustic fingerprints.  It does
+nothing unless UseFingerprints was called.
+
+The tossed rows are pushed into duplicates and pruned from scanned_files*/
+func (fdb *FileDB) resolveFingerprintDups(ctx context.Context) error {
+	if fdb.fingerprintAt <= 0 {
+		return nil
+	}
+	if err := fdb.fingerprintMissing(ctx); err != nil {
+		return err
+	}
+	clusters, err := fdb.fingerprintClusters(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d sets of files that sound alike\n", len(clusters))
+
+	for _, c := range clusters {
+		if ctx.Err() != nil {
+			break
+		}
+		query, args, err := sqlx.In(`SELECT * FROM scanned_files WHERE id IN (?)`, c.ids)
+		if err != nil {
+			return err
+		}
+		dupsThatSoundAlike := Duplicates{}
+		fdb.mutex.Lock()
+		err = fdb.db.Select(&dupsThatSoundAlike, fdb.db.Rebind(query), args...)
+		fdb.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		if len(dupsThatSoundAlike) < 2 {
+			continue
+		}
+		rule := fmt.Sprintf("fingerprint >= %g, sounding like #%d", fdb.fingerprintAt, c.ids[0])
+		if err := fdb.settle(byFingerprint, rule, c.score, dupsThatSoundAlike, nil); err != nil {
+			return err
+		}
+	}
+	fdb.MustExecMany([]string{
+		`DELETE FROM scanned_files WHERE id in (SELECT id from duplicates)`,
+	})
+	return ctx.Err()
+}
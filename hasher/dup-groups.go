@@ -0,0 +1,140 @@
+package hasher
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//The stages of analyze, and move, that group duplicates
+const (
+	byHash         = "hash"               //byte-identical files
+	byAudioHash    = "audio-hash"         //the same audio, retagged
+	byTags         = "artist-album-title" //the same tags and length
+	byFingerprint  = "fingerprint"        //files that sound alike
+	byMoveConflict = "move-conflict"      //a file identical to the one already at its destination
+)
+
+//The role of a file in its group
+const (
+	roleKeep      = "keep"
+	roleToss      = "toss"
+	roleUndecided = "undecided"
+)
+
+//Who decided a file's role
+const (
+	decidedAuto = "auto" //a policy or comparison picked the file to keep
+	decidedUser = "user" //someone picked it at the prompt
+)
+
+/*dupGroup is a row in dup_groups; a set of files a stage found to be
+duplicates, and the rule it went by, eg xxhash = 1234.  score is how alike
+the members are, from 0 to 1; 1 for exact matches.*/
+type dupGroup struct {
+	ID        sql.NullInt64   `db:"id"`
+	Stage     sql.NullString  `db:"stage"`
+	Rule      sql.NullString  `db:"rule"`
+	Score     sql.NullFloat64 `db:"score"`
+	CreatedAt sql.NullInt64   `db:"created_at"`
+}
+
+func (*dupGroup) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS dup_groups (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, stage TEXT, rule TEXT, score REAL, created_at INTEGER)`
+}
+
+//dupMember is a row in dup_members; a file in a group, and whether it is kept
+type dupMember struct {
+	GroupID   sql.NullInt64  `db:"group_id"`
+	FileID    sql.NullInt64  `db:"file_id"`
+	Role      sql.NullString `db:"role"`
+	DecidedBy sql.NullString `db:"decided_by"`
+}
+
+func (*dupMember) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS dup_members (group_id INTEGER NOT NULL, file_id INTEGER NOT NULL, role TEXT, decided_by TEXT, PRIMARY KEY (group_id, file_id))`
+}
+
+/*insertGroup adds a group and its members, first dropping any earlier group
+found by the same stage and rule that nothing was decided for, so running
+analyze again does not pile up copies of the groups that were skipped.*/
+func insertGroup(tx *sqlx.Tx, stage, rule string, score float64, members []dupMember) (int64, error) {
+	stale := `SELECT id FROM dup_groups WHERE stage = ? AND rule = ? AND id NOT IN (SELECT group_id FROM dup_members WHERE role != '` + roleUndecided + `')`
+	if _, err := tx.Exec(`DELETE FROM dup_members WHERE group_id IN (`+stale+`)`, stage, rule); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM dup_groups WHERE id IN (`+stale+`)`, stage, rule); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`INSERT INTO dup_groups (stage, rule, score, created_at) VALUES (?, ?, ?, ?)`, stage, rule, score, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	group, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range members {
+		if _, err := tx.Exec(`INSERT INTO dup_members (group_id, file_id, role, decided_by) VALUES (?, ?, ?, ?)`, group, m.FileID, m.Role, m.DecidedBy); err != nil {
+			return 0, err
+		}
+	}
+	return group, nil
+}
+
+/*recordGroup records d as a group found by stage under rule.  If keep is not
+nil the rest of d is tossed: moved from scanned_files into duplicates.
+Otherwise every member is left undecided.*/
+func (fdb *FileDB) recordGroup(stage, rule string, score float64, d Duplicates, keep *FileEntry, decidedBy string) error {
+	members := []dupMember{}
+	for _, r := range d {
+		m := dupMember{FileID: r.ID, Role: ns(roleUndecided)}
+		switch {
+		case keep == nil:
+		case r == keep:
+			m.Role, m.DecidedBy = ns(roleKeep), ns(decidedBy)
+		default:
+			m.Role, m.DecidedBy = ns(roleToss), ns(decidedBy)
+		}
+		members = append(members, m)
+	}
+
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	tx, err := fdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err := insertGroup(tx, stage, rule, score, members); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if keep != nil {
+		toss := d.OtherThan(keep)
+		if err := keepIn(tx, keep, toss); err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, r := range toss {
+			if _, err := tx.Exec(`DELETE FROM scanned_files WHERE id = ?`, r.ID.Int64); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+//keepIn copies dups into duplicates, pointing at keep, as part of tx
+func keepIn(tx *sqlx.Tx, keep *FileEntry, dups Duplicates) error {
+	dupStmt := fmt.Sprintf(`INSERT INTO duplicates (%s, duplicate_of) SELECT %s, %d from scanned_files where id = ?`, columnList(true), columnList(true), keep.ID.Int64)
+	for _, id := range dups {
+		if _, err := tx.Exec(dupStmt, id.ID.Int64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
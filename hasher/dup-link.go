@@ -0,0 +1,194 @@
+package hasher
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+//linkedFile is a row in linked; a duplicate that was replaced by a link to the file kept in its place
+type linkedFile struct {
+	ID       sql.NullInt64  `db:"id"`
+	FileID   sql.NullInt64  `db:"file_id"`
+	Path     sql.NullString `db:"path"`
+	Target   sql.NullString `db:"target"`
+	Kind     sql.NullString `db:"kind"`
+	XxHash   sql.NullString `db:"xxhash"`
+	LinkedAt sql.NullInt64  `db:"linked_at"`
+}
+
+func (*linkedFile) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS linked (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, file_id INTEGER, path TEXT, target TEXT, kind TEXT, xxhash TEXT, linked_at INTEGER)`
+}
+
+//duplicate is a row in duplicates
+type duplicate struct {
+	FileEntry
+	DuplicateOf sql.NullString `db:"duplicate_of"`
+}
+
+//hashFile returns the xxhash of the file at path as it is now
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r := &FileEntry{}
+	err = r.xxhash(f)
+	return r.XxHash.String, err
+}
+
+/*keeperFile finds the row for the file a duplicate was kept in favour of,
+from ref, its id.  If it has been moved since, Path is where it went.*/
+func (fdb *FileDB) keeperFile(ref string) (*FileEntry, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	keeper := &FileEntry{}
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a file id", ref)
+	}
+	for _, table := range []string{"scanned_files", "missing_tags", "moved"} {
+		err = fdb.db.Get(keeper, fmt.Sprintf(`SELECT id, path, size, mtime, inode, xxhash FROM %s WHERE id = ?`, table), id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil || table != "moved" {
+			return keeper, err
+		}
+		dest := ""
+		switch err := fdb.db.Get(&dest, `SELECT destination FROM operations WHERE kind = 'move' AND file_id = ? AND status IN ('done', 'copied') ORDER BY id DESC LIMIT 1`, id); err {
+		case nil:
+			keeper.Path.String = dest
+		case sql.ErrNoRows:
+			//already in the library when move found it; see keeperOf
+		default:
+			return nil, err
+		}
+		return keeper, nil
+	}
+	return nil, fmt.Errorf("no file with id %d", id)
+}
+
+/*DupLinker replaces each file in duplicates with a link to the file kept in
+its place, so anything pointing at the old path still finds the track.  The
+link is a hardlink where both are on the same filesystem and an absolute
+symlink otherwise.
+
+Both files are hashed first, in full if they never were, and left alone
+unless each still matches what was recorded for it and the two are
+byte-identical; a duplicate found by its audio, tags or fingerprint is not
+the same file.  The link is made beside the duplicate and renamed over it, so
+the path never goes missing.*/
+func (fdb *FileDB) DupLinker() error {
+	dups := []*duplicate{}
+	fdb.mutex.Lock()
+	err := fdb.db.Select(&dups, `SELECT id, path, size, mtime, inode, xxhash, duplicate_of FROM duplicates WHERE id NOT IN (SELECT file_id FROM linked)`)
+	fdb.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, dup := range dups {
+		keeper, err := fdb.keeperFile(dup.DuplicateOf.String)
+		if err != nil {
+			fmt.Printf("* [skip] %s: cannot find what it duplicates: %v\n", dup.Path.String, err)
+			continue
+		}
+		kind, err := fdb.linkDup(dup, keeper)
+		if err != nil {
+			fmt.Printf("* [skip] %s: %v\n", dup.Path.String, err)
+			continue
+		}
+		if kind == "" {
+			continue
+		}
+		n++
+		fdb.mutex.Lock()
+		_, err = fdb.db.Exec(`INSERT INTO linked (file_id, path, target, kind, xxhash, linked_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			dup.ID.Int64, dup.Path.String, keeper.Path.String, kind, dup.XxHash.String, time.Now().Unix())
+		fdb.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Linked %d of %d duplicates\n", n, len(dups))
+	return nil
+}
+
+//linkDup swaps dup for a link to keeper, returning the kind of link made, or "" in a dry run
+func (fdb *FileDB) linkDup(dup *duplicate, keeper *FileEntry) (string, error) {
+	path, target := dup.Path.String, keeper.Path.String
+	dupInfo, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	if !dupInfo.Mode().IsRegular() {
+		return "", fmt.Errorf("not a regular file")
+	}
+	keepInfo, err := os.Stat(target)
+	if err != nil {
+		return "", err
+	}
+	if os.SameFile(dupInfo, keepInfo) {
+		return "", fmt.Errorf("already linked to %s", target)
+	}
+
+	hashes := [2]string{}
+	for i, f := range []*FileEntry{&dup.FileEntry, keeper} {
+		if !f.XxHash.Valid && f.Size.Valid {
+			//never hashed in full, so check it is as it was when scanned before hashing it now
+			if info, err := os.Stat(f.Path.String); err != nil || !f.Unchanged(info) {
+				return "", fmt.Errorf("%s has changed since it was scanned", f.Path.String)
+			}
+		}
+		now, err := hashFile(f.Path.String)
+		if err != nil {
+			return "", err
+		}
+		if f.XxHash.Valid && now != f.XxHash.String {
+			return "", fmt.Errorf("%s has changed since it was scanned", f.Path.String)
+		}
+		f.XxHash = sql.NullString{String: now, Valid: true}
+		hashes[i] = now
+	}
+	if hashes[0] != hashes[1] {
+		return "", fmt.Errorf("not byte-identical to %s", target)
+	}
+
+	if fdb.dryRun {
+		fmt.Printf("* [dry-run] would link %s -> %s\n", path, target)
+		return "", nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".link")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+
+	kind := "hardlink"
+	if err := os.Link(target, tmp.Name()); err != nil {
+		if !isCrossDevice(err) {
+			return "", err
+		}
+		kind = "symlink"
+		if err := os.Symlink(target, tmp.Name()); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	fmt.Printf("* %s %s -> %s\n", kind, path, target)
+	return kind, nil
+}
@@ -0,0 +1,68 @@
+package hasher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//linkedDuplicate sets up a database in dir holding keep.mp3 and its duplicate dup.mp3, and runs DupLinker on it
+func linkedDuplicate(t *testing.T, dir string) (*FileDB, string, string) {
+	keep, dup := filepath.Join(dir, "keep.mp3"), filepath.Join(dir, "dup.mp3")
+	for _, p := range []string{keep, dup} {
+		if err := ioutil.WriteFile(p, []byte("the same bytes"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fdb := CreateFileDB(filepath.Join(dir, "test.db"))
+	for _, p := range []string{keep, dup} {
+		r, err := NewFileEntry(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fdb.Insert(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fdb.MustExecMany([]string{
+		`INSERT INTO duplicates (` + columnList(true) + `, duplicate_of) SELECT ` + columnList(true) + `, '1' FROM scanned_files WHERE id = 2`,
+		`DELETE FROM scanned_files WHERE id = 2`,
+	})
+	if err := fdb.DupLinker(); err != nil {
+		t.Fatal(err)
+	}
+	return fdb, keep, dup
+}
+
+func TestDupNukeLeavesLinks(t *testing.T) {
+	for _, quarantine := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "dup-link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		fdb, keep, dup := linkedDuplicate(t, dir)
+		defer fdb.Close()
+
+		q := ""
+		if quarantine {
+			q = filepath.Join(dir, "quarantine")
+		}
+		if err := fdb.DupNuker(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+		dupInfo, err := os.Lstat(dup)
+		if err != nil {
+			t.Fatalf("quarantine %v: the link was removed: %v", quarantine, err)
+		}
+		keepInfo, err := os.Stat(keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(dupInfo, keepInfo) {
+			t.Errorf("quarantine %v: %s is no longer linked to %s", quarantine, dup, keep)
+		}
+	}
+}
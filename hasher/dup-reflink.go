@@ -0,0 +1,134 @@
+package hasher
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+//errReflinkUnsupported is returned by dedupeRange when the filesystem cannot share extents
+var errReflinkUnsupported = errors.New("filesystem does not support sharing extents")
+
+//reflinkedFile is a row in reflinked; a duplicate whose blocks are now shared with the file kept in its place
+type reflinkedFile struct {
+	ID          sql.NullInt64  `db:"id"`
+	FileID      sql.NullInt64  `db:"file_id"`
+	Path        sql.NullString `db:"path"`
+	Target      sql.NullString `db:"target"`
+	Bytes       sql.NullInt64  `db:"bytes"`
+	ReflinkedAt sql.NullInt64  `db:"reflinked_at"`
+}
+
+func (*reflinkedFile) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS reflinked (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, file_id INTEGER, path TEXT, target TEXT, bytes INTEGER, reflinked_at INTEGER)`
+}
+
+/*DupReflinker has the filesystem share the blocks of each byte-identical
+duplicate with the file kept in its place, as with FIDEDUPERANGE on Btrfs or
+XFS.  Both paths stay as ordinary, independent files; only the storage is
+shared, until one of them is written to.
+
+Only rows whose xxhash matches their keeper's are considered, and both are
+hashed again first.  Pairs on filesystems without support are skipped.*/
+func (fdb *FileDB) DupReflinker() error {
+	dups := []*duplicate{}
+	fdb.mutex.Lock()
+	err := fdb.db.Select(&dups, `SELECT id, path, size, xxhash, duplicate_of FROM duplicates WHERE id NOT IN (SELECT file_id FROM reflinked) AND id NOT IN (SELECT file_id FROM linked)`)
+	fdb.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	n, unsupported, reclaimed := 0, 0, int64(0)
+	for _, dup := range dups {
+		keeper, err := fdb.keeperFile(dup.DuplicateOf.String)
+		if err != nil {
+			fmt.Printf("* [skip] %s: cannot find what it duplicates: %v\n", dup.Path.String, err)
+			continue
+		}
+		if !dup.XxHash.Valid || (keeper.XxHash.Valid && keeper.XxHash.String != dup.XxHash.String) {
+			continue //not byte-identical, eg only the audio matched
+		}
+		bytes, err := fdb.reflinkDup(dup, keeper)
+		switch {
+		case err == errReflinkUnsupported:
+			unsupported++
+			fmt.Printf("* [skip] %s: %v\n", dup.Path.String, err)
+			continue
+		case err != nil:
+			fmt.Printf("* [skip] %s: %v\n", dup.Path.String, err)
+			continue
+		case fdb.dryRun:
+			continue
+		}
+		n++
+		reclaimed += bytes
+		fdb.mutex.Lock()
+		_, err = fdb.db.Exec(`INSERT INTO reflinked (file_id, path, target, bytes, reflinked_at) VALUES (?, ?, ?, ?, ?)`,
+			dup.ID.Int64, dup.Path.String, keeper.Path.String, bytes, time.Now().Unix())
+		fdb.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Reflinked %d duplicates, reclaiming %.1f MiB; %d were on filesystems without support\n", n, float64(reclaimed)/(1<<20), unsupported)
+	return nil
+}
+
+//reflinkDup shares keeper's blocks with dup, returning how many bytes were deduped
+func (fdb *FileDB) reflinkDup(dup *duplicate, keeper *FileEntry) (int64, error) {
+	path, target := dup.Path.String, keeper.Path.String
+	dupInfo, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !dupInfo.Mode().IsRegular() {
+		return 0, fmt.Errorf("not a regular file")
+	}
+	keepInfo, err := os.Stat(target)
+	if err != nil {
+		return 0, err
+	}
+	if os.SameFile(dupInfo, keepInfo) {
+		return 0, fmt.Errorf("already linked to %s", target)
+	}
+	if dupInfo.Size() != keepInfo.Size() {
+		return 0, fmt.Errorf("%s is a different size", target)
+	}
+
+	for _, p := range []string{path, target} {
+		now, err := hashFile(p)
+		if err != nil {
+			return 0, err
+		}
+		if now != dup.XxHash.String {
+			return 0, fmt.Errorf("%s has changed since it was scanned", p)
+		}
+	}
+
+	if fdb.dryRun {
+		fmt.Printf("* [dry-run] would share %s's blocks with %s\n", target, path)
+		return 0, nil
+	}
+
+	src, err := os.Open(target)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	bytes, err := dedupeRange(src, dst, keepInfo.Size())
+	if err != nil {
+		return bytes, err
+	}
+	fmt.Printf("* reflinked %s -> %s (%d bytes)\n", path, target, bytes)
+	return bytes, nil
+}
@@ -1,7 +1,10 @@
 package hasher
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -15,7 +18,21 @@ func (h *hashcnt) Duplicates(db *sqlx.DB) Duplicates {
 	recs := Duplicates{}
 	db.Select(&recs, "SELECT * from scanned_files WHERE xxhash=$1", h.XxHash)
 	if len(recs) != h.Count {
-		log.Fatalf("Expected %d items with hash %q: but got %d instead. You need to look into this", h.Count, h.XxHash, len(recs))
+		log.Printf("Expected %d items with hash %q: but got %d instead; going with those\n", h.Count, h.XxHash, len(recs))
+	}
+	return recs
+}
+
+type audiocnt struct {
+	AudioHash string `db:"audio_hash"`
+	Count     int    `db:"count"`
+}
+
+func (h *audiocnt) Duplicates(db *sqlx.DB) Duplicates {
+	recs := Duplicates{}
+	db.Select(&recs, "SELECT * from scanned_files WHERE audio_hash=$1", h.AudioHash)
+	if len(recs) != h.Count {
+		log.Printf("Expected %d items with audio hash %q: but got %d instead; going with those\n", h.Count, h.AudioHash, len(recs))
 	}
 	return recs
 }
@@ -26,13 +43,86 @@ type albAtrTitle struct {
 	Artist string `db:"artist"`
 }
 
-func (a *albAtrTitle) Duplicates(db *sqlx.DB) Duplicates {
+/*Duplicates returns the rows with a's tags, split into sets of about the same
+length; more than one set means there are different versions, such as an
+album version and a radio edit.*/
+func (a *albAtrTitle) Duplicates(db *sqlx.DB, tolerance time.Duration) []Duplicates {
 	recs := Duplicates{}
 	db.Select(&recs, "SELECT * from scanned_files WHERE artist=$1 and album=$2 and title=$3", a.Artist, a.Album, a.Title)
 	if len(recs) < 2 {
-		log.Fatalf("Expected Duplicate items with title/album/artist %q/%q/%q You need to look into this", a.Title, a.Album, a.Artist)
+		log.Printf("Expected Duplicate items with title/album/artist %q/%q/%q but found %d; passing over them\n", a.Title, a.Album, a.Artist, len(recs))
+		return nil
+	}
+	return recs.ByDuration(tolerance)
+}
+
+/*resolve picks the record to keep from d, asking the user unless the database
+is unattended, in which case undecided sets are logged and left alone.  It
+also returns who made the choice, and what the user did at the prompt.*/
+func (fdb *FileDB) resolve(d Duplicates, comp FileEntryComparison) (*FileEntry, string, reviewAction) {
+	keep, undecided := d.Decide(fdb.guarded(comp), fdb.policy)
+	switch {
+	case keep != nil:
+		return keep, decidedAuto, actKeep
+	case fdb.unattended:
+		log.Printf("Undecided between %d files; left for review:\n%s\n", len(undecided), undecided)
+		return nil, "", actSkip
+	}
+	keep, action := undecided.choose()
+	return keep, decidedUser, action
+}
+
+/*settle resolves d, then records it in dup_groups as found by stage under
+rule, along with the outcome.  The decision is stored straight away, so
+nothing is lost if the run stops.
+
+Without a comparison, d is first split by ByDuration and each set of files
+of about the same length is settled on its own.
+
+When resuming a review, sets it already decided in the stage it stopped in
+are passed over, so it carries on from the first set with no decision.
+
+Undoing at the prompt takes back the last choice and asks about that set
+again before coming back to d.  Quitting returns ErrReviewPaused.*/
+func (fdb *FileDB) settle(stage, rule string, score float64, d Duplicates, comp FileEntryComparison) error {
+	if comp == nil {
+		//nothing else keeps files of different lengths apart
+		if lengths := d.ByDuration(fdb.durationTolerance); len(lengths) > 1 {
+			for i, same := range lengths {
+				if len(same) < 2 {
+					continue
+				}
+				if err := fdb.settle(stage, fmt.Sprintf("%s (length %d of %d)", rule, i+1, len(lengths)), score, same, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if done, err := fdb.decidedEarlier(stage, rule); err != nil || done {
+		return err
+	}
+	for {
+		keep, by, action := fdb.resolve(d, comp)
+		switch action {
+		case actQuit:
+			return ErrReviewPaused
+		case actUndo:
+			g, prev, err := fdb.undoLastDecision()
+			switch {
+			case err != nil:
+				log.Printf("%v\n", err)
+			case g == nil:
+				log.Println("Nothing to undo")
+			case len(prev) > 1:
+				if err := fdb.settle(g.Stage.String, g.Rule.String, g.Score.Float64, prev, comparisonFor(g.Stage.String)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		return fdb.recordGroup(stage, rule, score, d, keep, by)
 	}
-	return recs
 }
 
 /*resolveHashDups resolves duplicated by pooling all files with the same hash into a pool,
@@ -41,7 +131,7 @@ checking if the files in the pool are mostly the same, and if so, pickes on at r
 It pushes the dupicated pairs into duplicates with pointers to the original record.
 
 Once these dups have been 'handled', it prunes them from scanned_files*/
-func (fdb *FileDB) resolveHashDups() error {
+func (fdb *FileDB) resolveHashDups(ctx context.Context) error {
 	//build duplicated (hash, count) table
 	fdb.MustExecMany([]string{
 		`DROP TABLE IF EXISTS duplicated_hashes`,
@@ -55,23 +145,60 @@ func (fdb *FileDB) resolveHashDups() error {
 	fdb.mutex.Unlock()
 
 	for _, dup := range hashDups {
+		if ctx.Err() != nil {
+			break
+		}
 		dupsWithSameHash := dup.Duplicates(fdb.db)
-		if keep := dupsWithSameHash.Resolve(SameExceptPath); keep != nil {
-			toss := dupsWithSameHash.OtherThan(keep)
-			if err := fdb.Keep(keep, toss); err != nil {
-				return err
-			}
+		if err := fdb.settle(byHash, "xxhash = "+dup.XxHash, 1, dupsWithSameHash, SameExceptPath); err != nil {
+			return err
 		}
 	}
 	fdb.MustExecMany([]string{
-		`DELETE FROM scanned_files WHERE xxhash in (SELECT xxhash from duplicated_hashes)`,
+		`DELETE FROM scanned_files WHERE id in (SELECT id from duplicates)`,
 		`DROP TABLE IF EXISTS duplicated_hashes`,
 	})
-	return nil
+	return ctx.Err()
 }
 
-func (fdb *FileDB) resolveSameArtistAlbumTitle() error {
+/*resolveAudioHashDups resolves files whose audio payload hashes match even though
+the files as a whole do not, ie copies that were only retagged.
+
+The tossed rows are pushed into duplicates and pruned from scanned_files*/
+func (fdb *FileDB) resolveAudioHashDups(ctx context.Context) error {
 	fdb.MustExecMany([]string{
+		`DROP TABLE IF EXISTS duplicated_audio_hashes`,
+		`CREATE TABLE duplicated_audio_hashes AS SELECT audio_hash, count(*) AS count FROM scanned_files WHERE audio_hash IS NOT NULL GROUP BY audio_hash HAVING count(audio_hash) > 1`,
+	})
+
+	hashDups := []audiocnt{}
+
+	fdb.mutex.Lock()
+	fdb.db.Select(&hashDups, "SELECT * FROM duplicated_audio_hashes")
+	fdb.mutex.Unlock()
+
+	for _, dup := range hashDups {
+		if ctx.Err() != nil {
+			break
+		}
+		dupsWithSameAudio := dup.Duplicates(fdb.db)
+		if err := fdb.settle(byAudioHash, "audio_hash = "+dup.AudioHash, 1, dupsWithSameAudio, SameAudio); err != nil {
+			return err
+		}
+	}
+	fdb.MustExecMany([]string{
+		`DELETE FROM scanned_files WHERE id in (SELECT id from duplicates)`,
+		`DROP TABLE IF EXISTS duplicated_audio_hashes`,
+	})
+	return ctx.Err()
+}
+
+/*resolveSameArtistAlbumTitle resolves files with the same artist, album and
+title.  Those whose lengths differ by more than the duration tolerance are
+only resolved against files of their own length, and listed in
+different_versions, which is rebuilt on every run.*/
+func (fdb *FileDB) resolveSameArtistAlbumTitle(ctx context.Context) error {
+	fdb.MustExecMany([]string{
+		`DELETE FROM different_versions`,
 		`DROP TABLE IF EXISTS duplicated_aat`,
 		`CREATE TABLE duplicated_aat as 
 			SELECT title, album, artist from (
@@ -85,10 +212,25 @@ func (fdb *FileDB) resolveSameArtistAlbumTitle() error {
 	fdb.mutex.Unlock()
 
 	for _, dup := range artArtTitles {
-		dupsWithSameAAT := dup.Duplicates(fdb.db)
-		if keep := dupsWithSameAAT.Resolve(nil); keep != nil {
-			toss := dupsWithSameAAT.OtherThan(keep)
-			if err := fdb.Keep(keep, toss); err != nil {
+		if ctx.Err() != nil {
+			break
+		}
+		versions := dup.Duplicates(fdb.db, fdb.durationTolerance)
+		if len(versions) > 1 {
+			log.Printf("%q by %q on %q comes in %d different lengths; left as possible different versions\n", dup.Title, dup.Artist, dup.Album, len(versions))
+			if err := fdb.recordVersions(versions); err != nil {
+				return err
+			}
+		}
+		for i, dupsWithSameAAT := range versions {
+			if len(dupsWithSameAAT) < 2 {
+				continue
+			}
+			rule := fmt.Sprintf("artist, album, title = %q, %q, %q", dup.Artist, dup.Album, dup.Title)
+			if len(versions) > 1 {
+				rule += fmt.Sprintf(" (version %d of %d)", i+1, len(versions))
+			}
+			if err := fdb.settle(byTags, rule, 1, dupsWithSameAAT, nil); err != nil {
 				return err
 			}
 		}
@@ -97,17 +239,51 @@ func (fdb *FileDB) resolveSameArtistAlbumTitle() error {
 		`DELETE FROM scanned_files WHERE id in (SELECT id from duplicates)`,
 		`DROP TABLE IF EXISTS duplicated_aat`,
 	})
-	return nil
+	return ctx.Err()
 }
 
-/*Prune does some pre-defined sanity checks*/
-func (fdb *FileDB) Prune() error {
+/*Prune does some pre-defined sanity checks.  In a dry run they are done on a
+scratch copy of the database, and the rows that would change are reported.
+
+Each decision is saved as it is made.  If ctx is cancelled, the set being
+decided is finished and saved, and ctx's error returned; if the user quits at
+the prompt, ErrReviewPaused is.  Either way the review can be carried on
+from the stage it stopped in with SetResume.*/
+func (fdb *FileDB) Prune(ctx context.Context) error {
+	if fdb.dryRun {
+		return fdb.dryRunPrune(ctx)
+	}
+	session, from, err := fdb.startReview()
+	if err != nil {
+		return err
+	}
 	//run through a set of cleanup functions
-	for _, fxn := range []func() error{
-		fdb.resolveHashDups,
-		fdb.resolveSameArtistAlbumTitle,
-	} {
-		if err := fxn(); err != nil {
+	stages := []struct {
+		name string
+		fxn  func(context.Context) error
+	}{
+		{byHash, fdb.resolveHashDups},
+		{byAudioHash, fdb.resolveAudioHashDups},
+		{byTags, fdb.resolveSameArtistAlbumTitle},
+		{byFingerprint, fdb.resolveFingerprintDups},
+		{"fuzzy-tags", fdb.matchFuzzyTags},
+	}
+	for from != "" && len(stages) > 0 && stages[0].name != from {
+		stages = stages[1:]
+	}
+	for _, stage := range stages {
+		if err := fdb.updateReview(session, stage.name, "running"); err != nil {
+			return err
+		}
+		err := stage.fxn(ctx)
+		fdb.resuming = "" //only the stage it stopped in was part way through
+		if err != nil {
+			if ctx.Err() != nil || err == ErrReviewPaused {
+				if perr := fdb.updateReview(session, stage.name, "paused"); perr != nil {
+					return perr
+				}
+				return err
+			}
 			panic(err)
 		}
 	}
@@ -115,5 +291,5 @@ func (fdb *FileDB) Prune() error {
 		`DELETE FROM scanned_files WHERE id in (SELECT id from duplicates)`, // ... prune
 	})
 
-	return nil
+	return fdb.updateReview(session, "", "done")
 }
@@ -3,7 +3,9 @@ package hasher
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/manifoldco/promptui"
 	"github.com/xlab/tablewriter"
@@ -19,10 +21,10 @@ func (d Duplicates) String() string {
 
 func (d Duplicates) choices(header string) []string {
 	table := tablewriter.CreateTable()
-	table.AddHeaders("ID", "Path", "Title", "Album", "Artist", "Track", "Size")
+	table.AddHeaders("ID", "Path", "Title", "Album", "Artist", "Track", "Size", "Codec", "Kbps", "Length")
 	for _, dup := range d {
 		fmt.Println(dup)
-		table.AddRow(dup.ID.Int64, dup.Path.String, dup.Title.String, dup.Album.String, dup.Artist.String, dup.TrackNo.Int64, dup.Size.Int64)
+		table.AddRow(dup.ID.Int64, dup.Path.String, dup.Title.String, dup.Album.String, dup.Artist.String, dup.TrackNo.Int64, dup.Size.Int64, dup.Codec.String, dup.Bitrate.Int64, dup.duration())
 	}
 	c := []string{header}
 	for _, line := range strings.Split(table.Render(), "\n") {
@@ -69,6 +71,40 @@ func (d Duplicates) Uniques(comp FileEntryComparison) Duplicates {
 	return f(unique)
 }
 
+/*ByDuration splits d into sets, shortest first, in which each member is
+within tolerance of the length of the shortest, so no two members of a set
+are further apart than that.  Members whose length is not
+known join the set if there is only one, or make up a set of their own.*/
+func (d Duplicates) ByDuration(tolerance time.Duration) []Duplicates {
+	known, unknown := Duplicates{}, Duplicates{}
+	for _, r := range d {
+		if r.DurationMs.Valid {
+			known = append(known, r)
+		} else {
+			unknown = append(unknown, r)
+		}
+	}
+	sort.SliceStable(known, func(i, j int) bool { return known[i].DurationMs.Int64 < known[j].DurationMs.Int64 })
+
+	sets := []Duplicates{}
+	for _, r := range known {
+		if len(sets) == 0 || r.DurationMs.Int64-sets[len(sets)-1][0].DurationMs.Int64 > tolerance.Milliseconds() {
+			sets = append(sets, Duplicates{})
+		}
+		sets[len(sets)-1] = append(sets[len(sets)-1], r)
+	}
+	switch {
+	case len(unknown) == 0:
+	case len(sets) == 0:
+		sets = append(sets, unknown)
+	case len(sets) == 1:
+		sets[0] = append(sets[0], unknown...)
+	default:
+		sets = append(sets, unknown)
+	}
+	return sets
+}
+
 //OtherThan returns a copy of d, except for r.
 func (d Duplicates) OtherThan(r *FileEntry) Duplicates {
 	a := Duplicates{}
@@ -80,42 +116,97 @@ func (d Duplicates) OtherThan(r *FileEntry) Duplicates {
 	return a
 }
 
-/*Resolve Pickes the record to keep from a set.  If FileEntry is nil, it
-indicates the user didnt want to make a choice, and should be discarded
+/*Decide picks the record to keep from a set without asking anyone.  If it
+cannot, it returns nil and the members that still need a choice made.
+
+If policy is not nil it gets the first say, then comp collapses members that
+are the same.
 */
-func (d Duplicates) Resolve(comp FileEntryComparison) *FileEntry {
+func (d Duplicates) Decide(comp FileEntryComparison, policy *Policy) (*FileEntry, Duplicates) {
 	if len(d) < 1 {
-		panic("Resolve only work when working with > 1 element")
+		panic("Decide only work when working with > 1 element")
 	}
 
-	chooser := func(some Duplicates) *FileEntry {
-		choices := some.choices("Skip for now")
-		prompt := promptui.Select{
-			Size:         len(choices),
-			Label:        "Select which to mark as 'keep'.  Selecting anything other than a row will skip",
-			Items:        choices,
-			CursorPos:    4,
-			HideSelected: true,
-		}
-		i, _, err := prompt.Run()
-		if err != nil {
-			log.Fatalf("Prompt failed %v\n", err)
-			panic(err)
-		}
-		//dont select the Table
-		if i > 3 && i < len(choices)-2 {
-			return d[i-4]
+	some := d
+	if policy != nil {
+		if some = policy.Rank(d); len(some) == 1 {
+			return some[0], nil
 		}
-		return nil
 	}
 
 	if comp != nil {
-		diffs := d.Uniques(comp)
+		diffs := some.Uniques(comp)
 		if len(diffs) > 1 {
 			// crap - we go more than 1 unique entry - We need the user to intervine
-			return chooser(diffs)
+			return nil, diffs
+		}
+		return diffs[0], nil
+	}
+	return nil, some
+}
+
+/*Resolve Pickes the record to keep from a set.  If FileEntry is nil, it
+indicates the user didnt want to make a choice, and should be discarded.
+
+The user is only asked to choose between the members Decide could not separate.
+*/
+func (d Duplicates) Resolve(comp FileEntryComparison, policy *Policy) *FileEntry {
+	keep, undecided := d.Decide(comp, policy)
+	if keep != nil {
+		return keep
+	}
+	keep, _ = undecided.choose()
+	return keep
+}
+
+//What the user did at the prompt
+type reviewAction int
+
+const (
+	actKeep reviewAction = iota //picked a file to keep
+	actSkip                     //left the set undecided for now
+	actQuit                     //stopped, to carry on later
+	actUndo                     //took back their last choice
+)
+
+//reviewMenu are the entries above the table of files at the prompt
+var reviewMenu = []struct {
+	label  string
+	action reviewAction
+}{
+	{"Skip for now", actSkip},
+	{"Quit and save; carry on later with analyze --resume", actQuit},
+	{"Undo last decision", actUndo},
+}
+
+/*choose asks the user which of d to keep, or what else to do.  If the prompt
+fails, eg on Ctrl-C or the end of input, it is taken as quitting.*/
+func (d Duplicates) choose() (*FileEntry, reviewAction) {
+	table := d.choices("")[1:]
+	choices := []string{}
+	for _, m := range reviewMenu {
+		choices = append(choices, m.label)
+	}
+	firstRow := len(choices) + 3 //past the table's top border, headers and rule
+	choices = append(choices, table...)
+	prompt := promptui.Select{
+		Size:         len(choices),
+		Label:        "Select which to mark as 'keep'",
+		Items:        choices,
+		CursorPos:    firstRow,
+		HideSelected: true,
+	}
+	i, _, err := prompt.Run()
+	switch {
+	case err != nil:
+		if err != promptui.ErrInterrupt && err != promptui.ErrEOF {
+			log.Printf("Prompt failed: %v\n", err)
 		}
-		return diffs[0]
+		return nil, actQuit
+	case i < len(reviewMenu):
+		return nil, reviewMenu[i].action
+	case i >= firstRow && i < firstRow+len(d):
+		return d[i-firstRow], actKeep
 	}
-	return chooser(d)
+	return nil, actSkip //the rest of the table
 }
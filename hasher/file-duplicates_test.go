@@ -0,0 +1,53 @@
+package hasher
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func lengths(ms ...int64) Duplicates {
+	d := Duplicates{}
+	for i, m := range ms {
+		r := &FileEntry{ID: sql.NullInt64{Int64: int64(i + 1), Valid: true}}
+		if m >= 0 {
+			r.DurationMs = sql.NullInt64{Int64: m, Valid: true}
+		}
+		d = append(d, r)
+	}
+	return d
+}
+
+func TestByDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		ms   []int64
+		want [][]int64 //ids in each set
+	}{
+		{"one length", []int64{180000, 181000, 182000}, [][]int64{{1, 2, 3}}},
+		{"two versions", []int64{180000, 240000, 181500}, [][]int64{{1, 3}, {2}}},
+		{"chain is cut at the tolerance from the shortest", []int64{180000, 182500, 185000, 187500}, [][]int64{{1, 2}, {3, 4}}},
+		{"exactly the tolerance apart", []int64{180000, 183000}, [][]int64{{1, 2}}},
+		{"unknown joins the only set", []int64{180000, -1, 181000}, [][]int64{{1, 3, 2}}},
+		{"unknown on its own beside versions", []int64{180000, -1, 240000}, [][]int64{{1}, {3}, {2}}},
+		{"all unknown", []int64{-1, -1}, [][]int64{{1, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lengths(tt.ms...).ByDuration(3 * time.Second)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d sets, want %d", len(got), len(tt.want))
+			}
+			for i, set := range got {
+				if len(set) != len(tt.want[i]) {
+					t.Fatalf("set %d has %d members, want %d", i, len(set), len(tt.want[i]))
+				}
+				for j, r := range set {
+					if r.ID.Int64 != tt.want[i][j] {
+						t.Errorf("set %d member %d is #%d, want #%d", i, j, r.ID.Int64, tt.want[i][j])
+					}
+				}
+			}
+		})
+	}
+}
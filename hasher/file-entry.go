@@ -3,9 +3,11 @@ package hasher
 import (
 	"database/sql"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/cespare/xxhash"
 	"github.com/dhowden/tag"
@@ -40,10 +42,94 @@ type FileEntry struct {
 	Comment     sql.NullString `db:"comment"`
 	Size        sql.NullInt64  `db:"size"`
 	XxHash      sql.NullString `db:"xxhash"`
+	Mtime       sql.NullInt64  `db:"mtime"`
+	Inode       sql.NullInt64  `db:"inode"`
+	AudioHash   sql.NullString `db:"audio_hash"`
+	DurationMs  sql.NullInt64  `db:"duration_ms"`
+	Bitrate     sql.NullInt64  `db:"bitrate"`
+	SampleRate  sql.NullInt64  `db:"sample_rate"`
+	Channels    sql.NullInt64  `db:"channels"`
+	Codec       sql.NullString `db:"codec"`
+	VBR         sql.NullBool   `db:"vbr"`
+
+	PartialHash      sql.NullString `db:"partial_hash"`
+	AudioSize        sql.NullInt64  `db:"audio_size"`
+	PartialAudioHash sql.NullString `db:"partial_audio_hash"`
+	HashState        sql.NullString `db:"hash_state"`
+
+	Fingerprint sql.NullString `db:"fingerprint"` //see fingerprint.go; empty if the file could not be decoded
 }
 
-/*NewFileEntry reads from Path and returns some info about the file at Path*/
-func NewFileEntry(path string) *FileEntry {
+//column is a single scanned_files column and its SQL declaration
+type column struct {
+	name, decl string
+}
+
+//columns are the scanned_files columns, in table order.  New columns go on the end; migrate() appends them to older databases
+var columns = []column{
+	{"id", "INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT"},
+	{"path", "TEXT"},
+	{"filename", "TEXT"},
+	{"extension", "TEXT"},
+	{"format", "TEXT"},
+	{"file_type", "TEXT"},
+	{"title", "TEXT"},
+	{"album", "TEXT"},
+	{"artist", "TEXT"},
+	{"album_artist", "TEXT"},
+	{"composer", "TEXT"},
+	{"genre", "TEXT"},
+	{"year", "INTEGER"},
+	{"track_no", "INTEGER"},
+	{"track_total", "INTEGER"},
+	{"disk_no", "INTEGER"},
+	{"disk_total", "INTEGER"},
+	{"comment", "TEXT"},
+	{"size", "INTEGER"},
+	{"xxhash", "TEXT"},
+	{"mtime", "INTEGER"},
+	{"inode", "INTEGER"},
+	{"audio_hash", "TEXT"},
+	{"duration_ms", "INTEGER"},
+	{"bitrate", "INTEGER"},
+	{"sample_rate", "INTEGER"},
+	{"channels", "INTEGER"},
+	{"codec", "TEXT"},
+	{"vbr", "INTEGER"},
+	{"partial_hash", "TEXT"},
+	{"audio_size", "INTEGER"},
+	{"partial_audio_hash", "TEXT"},
+	{"hash_state", "TEXT"},
+	{"fingerprint", "TEXT"},
+}
+
+//columnNames returns the scanned_files column names, optionally without id
+func columnNames(withID bool) []string {
+	names := []string{}
+	for _, c := range columns {
+		if c.name == "id" && !withID {
+			continue
+		}
+		names = append(names, c.name)
+	}
+	return names
+}
+
+//columnList is columnNames joined for use in a SQL statement
+func columnList(withID bool) string {
+	return strings.Join(columnNames(withID), ", ")
+}
+
+/*NewFileEntry reads from Path and returns some info about the file at Path,
+or an error if it could not be read*/
+func NewFileEntry(path string) (*FileEntry, error) {
+	return readFileEntry(path, true)
+}
+
+/*readFileEntry reads the tags and audio properties of the file at path.  If
+full, it hashes the file and its audio payload too; otherwise that is left to
+completeHashes, which only does it for files that might be duplicates.*/
+func readFileEntry(path string, full bool) (*FileEntry, error) {
 	rst := &FileEntry{
 		Path:      ns(path),
 		Filename:  ns(filepath.Base(path)),
@@ -55,25 +141,71 @@ func NewFileEntry(path string) *FileEntry {
 
 	file, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer file.Close()
 
-	if info, err := file.Stat(); err == nil {
-		rst.Size = sql.NullInt64{Int64: info.Size(), Valid: true}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
 	}
+	rst.statInfo(info)
 
 	rst.tagMetadata(file)
-	rst.xxhash(file)
-	return rst
+	if payload := audioPayload(file, rst.Size.Int64); payload != nil {
+		rst.AudioSize = sql.NullInt64{Int64: spanLength(payload), Valid: true}
+	}
+	rst.audioProperties(file)
+	rst.HashState = ns(hashLazy)
+	if !full {
+		return rst, nil
+	}
+
+	if err := rst.xxhash(file); err != nil {
+		return nil, err
+	}
+	rst.audioHash(file)
+	rst.HashState = ns(hashFull)
+	return rst, nil
 }
 
 func (*FileEntry) createStmt() string {
-	return `CREATE TABLE IF NOT EXISTS scanned_files (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, path TEXT, filename TEXT, extension TEXT, format TEXT, file_type TEXT, title TEXT, album TEXT, artist TEXT, album_artist TEXT, composer TEXT, genre TEXT, year INTEGER, track_no INTEGER, track_total INTEGER, disk_no INTEGER, disk_total INTEGER, comment TEXT, size INTEGER, xxhash TEXT)`
+	decls := []string{}
+	for _, c := range columns {
+		decls = append(decls, c.name+" "+c.decl)
+	}
+	return `CREATE TABLE IF NOT EXISTS scanned_files (` + strings.Join(decls, ", ") + `)`
 }
 
 func (*FileEntry) insertStmt() string {
-	return `INSERT INTO scanned_files (path, filename, extension, format, file_type, title, album, artist, album_artist, composer, genre, year, track_no, track_total, disk_no, disk_total, comment, size, xxhash) VALUES (:path,:filename,:extension,:format,:file_type,:title,:album,:artist,:album_artist,:composer,:genre,:year,:track_no,:track_total,:disk_no,:disk_total,:comment,:size,:xxhash)`
+	return `INSERT INTO scanned_files (` + columnList(false) + `) VALUES (:` + strings.Join(columnNames(false), ",:") + `)`
+}
+
+func (*FileEntry) updateStmt() string {
+	sets := []string{}
+	for _, name := range columnNames(false) {
+		sets = append(sets, name+"=:"+name)
+	}
+	return `UPDATE scanned_files SET ` + strings.Join(sets, ", ") + ` WHERE id=:id`
+}
+
+//statInfo records the size, modification time and inode from info
+func (r *FileEntry) statInfo(info os.FileInfo) {
+	r.Size = sql.NullInt64{Int64: info.Size(), Valid: true}
+	r.Mtime = sql.NullInt64{Int64: info.ModTime().UnixNano(), Valid: true}
+	if ino, ok := inode(info); ok {
+		r.Inode = sql.NullInt64{Int64: int64(ino), Valid: true}
+	}
+}
+
+//Unchanged returns true if info has the same size, modification time and inode as was last recorded
+func (r *FileEntry) Unchanged(info os.FileInfo) bool {
+	o := &FileEntry{}
+	o.statInfo(info)
+	return r.Size.Valid && r.Mtime.Valid &&
+		r.Size.Int64 == o.Size.Int64 &&
+		r.Mtime.Int64 == o.Mtime.Int64 &&
+		r.Inode.Int64 == o.Inode.Int64 && r.Inode.Valid == o.Inode.Valid
 }
 
 func (r *FileEntry) tagMetadata(file *os.File) {
@@ -99,17 +231,39 @@ func (r *FileEntry) tagMetadata(file *os.File) {
 	}
 }
 
-func (r *FileEntry) xxhash(file *os.File) {
+//readBuffers are reused between files by the hashing functions, rather than each allocating its own
+var readBuffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, 64<<10)
+	return &b
+}}
+
+func (r *FileEntry) xxhash(file *os.File) error {
 	file.Seek(0, 0)
 	dig := xxhash.New()
-	buff := make([]byte, 4096)
+	pooled := readBuffers.Get().(*[]byte)
+	defer readBuffers.Put(pooled)
+	buff := *pooled
 	for {
 		n, err := file.Read(buff)
 		dig.Write(buff[:n])
-		if err != nil {
+		if err == io.EOF {
 			r.XxHash = sql.NullString{String: fmt.Sprintf("%d", dig.Sum64()), Valid: true}
-			return
+			return nil
 		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*audioHash hashes only the audio payload, so copies that differ just in their tags still match*/
+func (r *FileEntry) audioHash(file *os.File) {
+	ranges := audioPayload(file, r.Size.Int64)
+	if ranges == nil {
+		return
+	}
+	if h, err := hashRanges(file, ranges); err == nil {
+		r.AudioHash = ns(h)
 	}
 }
 
@@ -136,9 +290,27 @@ func (r *FileEntry) String() string {
 	s += fmt.Sprintf("\t- Comment     :%s\n", r.Comment.String)
 	s += fmt.Sprintf("\t- Size        :%d\n", r.Size.Int64)
 	s += fmt.Sprintf("\t- XxHash      :%s\n", r.XxHash.String)
+	s += fmt.Sprintf("\t- Mtime       :%d\n", r.Mtime.Int64)
+	s += fmt.Sprintf("\t- Inode       :%d\n", r.Inode.Int64)
+	s += fmt.Sprintf("\t- AudioHash   :%s\n", r.AudioHash.String)
+	s += fmt.Sprintf("\t- DurationMs  :%d\n", r.DurationMs.Int64)
+	s += fmt.Sprintf("\t- Bitrate     :%d\n", r.Bitrate.Int64)
+	s += fmt.Sprintf("\t- SampleRate  :%d\n", r.SampleRate.Int64)
+	s += fmt.Sprintf("\t- Channels    :%d\n", r.Channels.Int64)
+	s += fmt.Sprintf("\t- Codec       :%s\n", r.Codec.String)
+	s += fmt.Sprintf("\t- VBR         :%v\n", r.VBR.Bool)
 	return s
 }
 
+//duration formats DurationMs as m:ss
+func (r *FileEntry) duration() string {
+	if !r.DurationMs.Valid {
+		return ""
+	}
+	secs := r.DurationMs.Int64 / 1000
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
 //HasMetadata  if it has an title, artist,
 func (r *FileEntry) HasMetadata() bool {
 	return r.Title.Valid && r.Title.String != "" &&
@@ -161,11 +333,18 @@ func (r *FileEntry) Delete() error {
 	return nil
 }
 
-//Skipped is a special error indicating that this file record info was skipped / not moved
-type Skipped error
+/*Skipped is a special error indicating that this file record info was skipped / not moved.
+It is a struct, not an interface, so a type switch only matches it and not every error.*/
+type Skipped struct {
+	Reason error
+}
+
+func (s Skipped) Error() string {
+	return s.Reason.Error()
+}
 
-func fromE(err string, args ...interface{}) Skipped {
-	return Skipped(fmt.Errorf(err, args...))
+func fromE(err string, args ...interface{}) error {
+	return Skipped{Reason: fmt.Errorf(err, args...)}
 }
 
 //ValidFormat returns true if the format and file type are ok
@@ -183,27 +362,13 @@ func (r *FileEntry) ValidFormat() bool {
 	}
 }
 
-//NewName Suggests a new name
+//NewName Suggests a new name, laid out as DefaultFormat
 func (r *FileEntry) NewName() string {
-	un := func(p sql.NullString) string {
-		if p.String == "" {
-			return "Unknown"
-		}
-		return strings.ReplaceAll(p.String, "\\", "\\\\")
-	}
-	ui := func(p sql.NullInt64) string {
-		if p.Int64 == 0 {
-			return "00"
-		}
-		return fmt.Sprintf("%02d", p.Int64)
-	}
-	if r.AlbumArtist.Valid && r.AlbumArtist.String != "" {
-		return filepath.Join(un(r.Artist), un(r.AlbumArtist), ui(r.TrackNo)+" "+un(r.Title)+r.Extension.String)
-	}
-	return filepath.Join(un(r.Artist), un(r.Album), ui(r.TrackNo)+" "+un(r.Title)+r.Extension.String)
+	name, _ := defaultNamer.Name(r)
+	return name
 }
 
-/*Rename moves the file at `path` to a new path determined by:
+/*Rename moves the file at `path` to a new path determined by namer, or if it is nil:
  * <Root>/<Artist>/<Album>/<TrackNo>. - <Track>.<ext>
 It refuses to move items that:
 * Do not currently exist on the FS
@@ -213,33 +378,66 @@ It refuses to move items that:
 It also:
 * Replaces all empty values for Artist, Albums are replaced with "Unknown"
 * Will not replace files unless asking.
+* Copies across filesystems, checking the copy against XxHash before removing
+the original.  copied is true when that happened.
 
 */
-func (r *FileEntry) Rename(root string) error {
+func (r *FileEntry) Rename(root string, namer *Namer) (copied bool, err error) {
+	newPath, err := r.Destination(root, namer)
+	if err != nil {
+		return false, err
+	}
+	return r.MoveTo(newPath)
+}
+
+/*MoveTo moves the file to newPath, creating its directory; it replaces anything
+already there.  If it has to be copied and was never hashed in full, it is
+hashed first, once it is shown to be the file that was scanned, so the copy is
+checked against that.*/
+func (r *FileEntry) MoveTo(newPath string) (copied bool, err error) {
+	parent, _ := filepath.Split(newPath)
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		return false, err
+	}
+	err = os.Rename(r.Path.String, newPath)
+	if err == nil || !isCrossDevice(err) {
+		return false, err
+	}
+	if !r.XxHash.Valid {
+		if err := r.hashAsScanned(); err != nil {
+			return false, err
+		}
+	}
+	return true, copyVerified(r.Path.String, newPath, r.XxHash.String)
+}
+
+/*Destination returns where Rename would move the file under root, or a Skipped
+error saying why it would not.  If the destination is taken, it returns it
+along with an Exists error.*/
+func (r *FileEntry) Destination(root string, namer *Namer) (string, error) {
 	//MP4 doesnt have a FileType.
 	if !r.ValidFormat() {
-		return fromE("Invalid file - unknown type or format")
+		return "", fromE("Invalid file - unknown type or format")
 	}
 	if !r.Album.Valid || !r.Artist.Valid || !r.Title.Valid {
-		return fromE("Artist, Album and Title cannot be NULL values")
+		return "", fromE("Artist, Album and Title cannot be NULL values")
 	}
 	if stat, err := os.Stat(r.Path.String); err != nil || !stat.Mode().IsRegular() {
-		return fromE("Appears to not exist on file s.  ystem: %v", err)
+		return "", fromE("Appears to not exist on file s.  ystem: %v", err)
 	}
 
-	newPath := filepath.Join(root, r.NewName())
-	if st, er := os.Stat(newPath); er == nil && st.Mode().IsRegular() {
-		return fromE("Remote Path Exists!!!")
+	if namer == nil {
+		namer = defaultNamer
 	}
-
-	mktree := func(path string) {
-		parent, _ := filepath.Split(path)
-		if err := os.MkdirAll(parent, os.ModePerm); err != nil {
-			panic(err)
-		}
+	name, err := namer.Name(r)
+	if err != nil {
+		return "", fromE("Cannot name file: %v", err)
+	}
+	newPath := filepath.Join(root, name)
+	if st, er := os.Stat(newPath); er == nil && st.Mode().IsRegular() {
+		return newPath, Exists{Path: newPath}
 	}
-	mktree(newPath)
-	return os.Rename(r.Path.String, newPath)
+	return newPath, nil
 }
 
 //A FileEntryComparison returns True if the two results are similar enough by some mechanism
@@ -272,5 +470,15 @@ func SameExceptPath(r, o *FileEntry) (same bool) {
 		r.DiskTotal.Int64 == o.DiskTotal.Int64 && r.DiskTotal.Valid == o.DiskTotal.Valid &&
 		r.Comment.String == o.Comment.String && r.Comment.Valid == o.Comment.Valid &&
 		r.Size.Int64 == o.Size.Int64 && r.Size.Valid == o.Size.Valid &&
-		r.XxHash.String == o.XxHash.String && r.XxHash.Valid == o.XxHash.Valid
+		r.XxHash.String == o.XxHash.String && r.XxHash.Valid == o.XxHash.Valid &&
+		r.DurationMs.Int64 == o.DurationMs.Int64 && r.DurationMs.Valid == o.DurationMs.Valid
+}
+
+/*SameAudio returns True if both have the same audio payload, ignoring everything
+about their tags*/
+func SameAudio(r, o *FileEntry) bool {
+	if r == nil || o == nil {
+		panic("Cannot perform comparison with nil FileEntrys")
+	}
+	return r.AudioHash.Valid && o.AudioHash.Valid && r.AudioHash.String == o.AudioHash.String
 }
@@ -0,0 +1,317 @@
+package hasher
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"sort"
+)
+
+/*Acoustic fingerprints, in the style of Chromaprint.
+
+Audio is taken down to mono at fingerprintRate and cut into overlapping
+frames.  The spectrum of each frame is folded into 12 pitch classes (a
+chroma vector), which are smoothed over time and normalised.  A set of
+Haar-like filters is then run over the chroma "image", each quantised to 2
+bits, giving one 32-bit value per frame.
+
+Re-encoding, a different bitrate or codec, or a change in volume leave most
+bits alone, so two fingerprints can be compared by how many bits they share.
+The values are not compatible with Chromaprint or AcoustID.*/
+
+const (
+	fingerprintRate    = 11025
+	fingerprintFrame   = 4096
+	fingerprintHop     = fingerprintFrame / 3
+	fingerprintSeconds = 120 //only the start of each track is fingerprinted
+	chromaMinFreq      = 28
+	chromaMaxFreq      = 3520
+)
+
+//chromaFilter smooths each chroma band over time
+var chromaFilter = []float64{0.25, 0.75, 1.0, 0.75, 0.25}
+
+/*A chromaClassifier compares areas of the chroma image in one of six
+patterns, spanning bands [y, y+height) and width frames, and quantises the
+log ratio of the two into 2 bits at thresholds.*/
+type chromaClassifier struct {
+	kind, y, height, width int
+	thresholds             [3]float64
+}
+
+var chromaClassifiers = []chromaClassifier{
+	{0, 4, 3, 15, [3]float64{1.98215, 2.35817, 2.63523}},
+	{4, 4, 6, 15, [3]float64{-1.03809, -0.651211, -0.282167}},
+	{1, 0, 4, 16, [3]float64{-0.298702, 0.119262, 0.558497}},
+	{3, 8, 2, 12, [3]float64{-0.105439, 0.0153946, 0.135898}},
+	{3, 4, 4, 8, [3]float64{-0.142891, 0.0258736, 0.200632}},
+	{4, 0, 3, 5, [3]float64{-0.826319, -0.590612, -0.368214}},
+	{1, 2, 2, 9, [3]float64{-0.557409, -0.233035, 0.0534525}},
+	{2, 7, 3, 4, [3]float64{-0.0646826, 0.00620476, 0.0784847}},
+	{2, 6, 2, 16, [3]float64{-0.192387, -0.029699, 0.215855}},
+	{2, 1, 3, 2, [3]float64{-0.0397818, -0.00568076, 0.0292026}},
+	{5, 10, 1, 15, [3]float64{-0.53823, -0.369934, -0.190235}},
+	{3, 6, 2, 10, [3]float64{-0.124877, 0.0296483, 0.139239}},
+	{2, 1, 1, 14, [3]float64{-0.101475, 0.0225617, 0.231971}},
+	{3, 5, 6, 4, [3]float64{-0.0799915, -0.00729616, 0.063262}},
+	{1, 9, 2, 12, [3]float64{-0.272556, 0.019424, 0.302559}},
+	{3, 4, 2, 14, [3]float64{-0.164292, -0.0321188, 0.0846339}},
+}
+
+//maxClassifierWidth is how many frames the widest classifier spans
+const maxClassifierWidth = 16
+
+//fingerprintPCM fingerprints mono samples at fingerprintRate
+func fingerprintPCM(samples []float64) []uint32 {
+	chroma := chromaVectors(samples)
+	if len(chroma) < maxClassifierWidth {
+		return nil
+	}
+	image := newIntegralImage(chroma)
+	prints := make([]uint32, 0, len(chroma)-maxClassifierWidth+1)
+	for t := 0; t+maxClassifierWidth <= len(chroma); t++ {
+		v := uint32(0)
+		for _, c := range chromaClassifiers {
+			v = v<<2 | grayCode[c.quantise(c.apply(image, t))]
+		}
+		prints = append(prints, v)
+	}
+	return prints
+}
+
+var grayCode = [4]uint32{0, 1, 3, 2}
+
+//chromaVectors returns the smoothed, normalised 12-band chroma of each frame
+func chromaVectors(samples []float64) [][12]float64 {
+	window := make([]float64, fingerprintFrame)
+	for i := range window {
+		window[i] = 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/float64(fingerprintFrame-1))
+	}
+	//which chroma band each FFT bin falls in, or -1
+	bands := make([]int, fingerprintFrame/2)
+	for i := range bands {
+		bands[i] = -1
+		freq := float64(i) * fingerprintRate / fingerprintFrame
+		if freq < chromaMinFreq || freq > chromaMaxFreq {
+			continue
+		}
+		octave := math.Log2(freq / (440.0 / 16))
+		bands[i] = int(12*(octave-math.Floor(octave))) % 12
+	}
+
+	raw := [][12]float64{}
+	buf := make([]complex128, fingerprintFrame)
+	for start := 0; start+fingerprintFrame <= len(samples); start += fingerprintHop {
+		for i := range buf {
+			buf[i] = complex(samples[start+i]*window[i], 0)
+		}
+		fft(buf)
+		var c [12]float64
+		for i, b := range bands {
+			if b >= 0 {
+				m := cmplx.Abs(buf[i])
+				c[b] += m * m
+			}
+		}
+		raw = append(raw, c)
+	}
+
+	out := [][12]float64{}
+	for t := 0; t+len(chromaFilter) <= len(raw); t++ {
+		var c [12]float64
+		for k, w := range chromaFilter {
+			for b := range c {
+				c[b] += w * raw[t+k][b]
+			}
+		}
+		norm := 0.0
+		for _, v := range c {
+			norm += v * v
+		}
+		norm = math.Sqrt(norm)
+		for b := range c {
+			if norm < 0.01 {
+				c[b] = 0
+			} else {
+				c[b] /= norm
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+//integralImage holds the running sums of a chroma image, so any rectangle of it can be summed in constant time
+type integralImage [][13]float64
+
+func newIntegralImage(chroma [][12]float64) integralImage {
+	img := make(integralImage, len(chroma)+1)
+	for t, c := range chroma {
+		for b := 0; b < 12; b++ {
+			img[t+1][b+1] = c[b] + img[t][b+1] + img[t+1][b] - img[t][b]
+		}
+	}
+	return img
+}
+
+//area sums frames [t, t+w) of bands [y, y+h)
+func (img integralImage) area(t, y, w, h int) float64 {
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	return img[t+w][y+h] - img[t][y+h] - img[t+w][y] + img[t][y]
+}
+
+func subtractLog(a, b float64) float64 {
+	return math.Log1p(a) - math.Log1p(b)
+}
+
+func (c chromaClassifier) apply(img integralImage, t int) float64 {
+	y, w, h := c.y, c.width, c.height
+	switch c.kind {
+	case 1: //upper bands against lower
+		h2 := h / 2
+		return subtractLog(img.area(t, y+h2, w, h-h2), img.area(t, y, w, h2))
+	case 2: //later frames against earlier
+		w2 := w / 2
+		return subtractLog(img.area(t+w2, y, w-w2, h), img.area(t, y, w2, h))
+	case 3: //diagonal quarters against each other
+		h2, w2 := h/2, w/2
+		a := img.area(t, y+h2, w2, h-h2) + img.area(t+w2, y, w-w2, h2)
+		b := img.area(t, y, w2, h2) + img.area(t+w2, y+h2, w-w2, h-h2)
+		return subtractLog(a, b)
+	case 4: //middle third of the bands against the outer two
+		h3 := h / 3
+		return subtractLog(img.area(t, y+h3, w, h3), img.area(t, y, w, h3)+img.area(t, y+2*h3, w, h3))
+	case 5: //middle third of the frames against the outer two
+		w3 := w / 3
+		return subtractLog(img.area(t+w3, y, w3, h), img.area(t, y, w3, h)+img.area(t+2*w3, y, w3, h))
+	}
+	return subtractLog(img.area(t, y, w, h), 0)
+}
+
+func (c chromaClassifier) quantise(v float64) int {
+	for i, th := range c.thresholds {
+		if v < th {
+			return i
+		}
+	}
+	return 3
+}
+
+//fft transforms x in place; len(x) must be a power of 2
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+//encodeFingerprint packs a fingerprint for the fingerprint column
+func encodeFingerprint(fp []uint32) string {
+	b := make([]byte, 4*len(fp))
+	for i, v := range fp {
+		binary.LittleEndian.PutUint32(b[4*i:], v)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func decodeFingerprint(s string) []uint32 {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil
+	}
+	fp := make([]uint32, len(b)/4)
+	for i := range fp {
+		fp[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return fp
+}
+
+//fingerprintMaxOffset is how far apart, in frames, two fingerprints are slid to line them up; about 10 seconds
+const fingerprintMaxOffset = 10 * fingerprintRate / fingerprintHop
+
+//fingerprintMinOverlap is the fewest frames two fingerprints must share to be compared; about 5 seconds
+const fingerprintMinOverlap = 5 * fingerprintRate / fingerprintHop
+
+/*fingerprintSimilarity is the fraction of bits a and b share where they line
+up best, from 0.5 or so for unrelated audio to 1 for the same.
+
+Rather than sliding one over the other at every offset, the offsets at which
+whole values match exactly are tallied, and only the likeliest few, and no
+offset at all, are scored.*/
+func fingerprintSimilarity(a, b []uint32) float64 {
+	at := map[uint32][]int{}
+	for j, v := range b {
+		at[v] = append(at[v], j)
+	}
+	votes := map[int]int{0: 0}
+	for i, v := range a {
+		if len(at[v]) > 8 {
+			continue //silence and the like match everywhere
+		}
+		for _, j := range at[v] {
+			if off := i - j; off >= -fingerprintMaxOffset && off <= fingerprintMaxOffset {
+				votes[off]++
+			}
+		}
+	}
+	offsets := make([]int, 0, len(votes))
+	for off := range votes {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return votes[offsets[i]] > votes[offsets[j]] })
+	if len(offsets) > 4 {
+		offsets = append(offsets[:4], 0)
+	}
+
+	best := 0.0
+	for _, off := range offsets {
+		if s := alignedSimilarity(a, b, off); s > best {
+			best = s
+		}
+	}
+	return best
+}
+
+//alignedSimilarity is the fraction of bits shared by a[i+off] and b[i] where they overlap
+func alignedSimilarity(a, b []uint32, off int) float64 {
+	i, j := 0, 0
+	if off > 0 {
+		i = off
+	} else {
+		j = -off
+	}
+	n := len(a) - i
+	if len(b)-j < n {
+		n = len(b) - j
+	}
+	if n < fingerprintMinOverlap {
+		return 0
+	}
+	errs := 0
+	for k := 0; k < n; k++ {
+		errs += bits.OnesCount32(a[i+k] ^ b[j+k])
+	}
+	return 1 - float64(errs)/float64(32*n)
+}
@@ -0,0 +1,260 @@
+package hasher
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+//DefaultFuzzyThreshold is how alike, by Jaro-Winkler, the normalised tags of two files must be to make them candidates, unless told otherwise
+const DefaultFuzzyThreshold = 0.92
+
+//SetFuzzyThreshold sets how alike the normalised tags of two files must be for analyze to list them as candidates; 0 turns the stage off
+func (fdb *FileDB) SetFuzzyThreshold(threshold float64) {
+	fdb.fuzzyAt = threshold
+}
+
+//fuzzyCandidate is a row in fuzzy_candidates; a file whose tags nearly match the others in its group
+type fuzzyCandidate struct {
+	ID      sql.NullInt64   `db:"id"`
+	GroupID sql.NullInt64   `db:"group_id"`
+	FileID  sql.NullInt64   `db:"file_id"`
+	Path    sql.NullString  `db:"path"`
+	Artist  sql.NullString  `db:"artist"`
+	Album   sql.NullString  `db:"album"`
+	Title   sql.NullString  `db:"title"`
+	Score   sql.NullFloat64 `db:"score"`
+	FoundAt sql.NullInt64   `db:"found_at"`
+}
+
+func (*fuzzyCandidate) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS fuzzy_candidates (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, group_id INTEGER, file_id INTEGER, path TEXT, artist TEXT, album TEXT, title TEXT, score REAL, found_at INTEGER)`
+}
+
+//annotation matches bracketed asides that do not change which song it is, eg (Remastered 2009), [Live], (feat. Someone)
+var annotation = regexp.MustCompile(`\s*[(\[][^)\]]*\b(remaster(ed)?|live|feat|ft|featuring)\b[^)\]]*[)\]]`)
+
+//leadingArticles are moved to the end of a name, so "The Beatles" and "Beatles, The" agree
+var leadingArticles = []string{"the ", "a ", "an "}
+
+/*normaliseTag reduces a tag to a form that spelling differences do not
+change: case-folded, without accents or bracketed remaster, live and
+featuring annotations, with any leading article moved to the end, and with
+punctuation dropped.*/
+func normaliseTag(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, norm.NFD.String(s))
+	s = annotation.ReplaceAllString(s, "")
+	s = strings.TrimSpace(s)
+	for _, a := range leadingArticles {
+		if strings.HasPrefix(s, a) {
+			s = s[len(a):] + " " + strings.TrimSpace(a)
+			break
+		}
+	}
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+//jaroWinkler is the Jaro-Winkler similarity of a and b, from 0 for nothing in common to 1 for the same
+func jaroWinkler(a, b string) float64 {
+	s, t := []rune(a), []rune(b)
+	if len(s) == 0 && len(t) == 0 {
+		return 1
+	}
+	if len(s) == 0 || len(t) == 0 {
+		return 0
+	}
+	window := len(s)
+	if len(t) > window {
+		window = len(t)
+	}
+	window = window/2 - 1
+	if window < 0 {
+		window = 0
+	}
+
+	sMatched, tMatched := make([]bool, len(s)), make([]bool, len(t))
+	matches := 0
+	for i := range s {
+		lo, hi := i-window, i+window+1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(t) {
+			hi = len(t)
+		}
+		for j := lo; j < hi; j++ {
+			if !tMatched[j] && s[i] == t[j] {
+				sMatched[i], tMatched[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+	transpositions, j := 0, 0
+	for i := range s {
+		if !sMatched[i] {
+			continue
+		}
+		for !tMatched[j] {
+			j++
+		}
+		if s[i] != t[j] {
+			transpositions++
+		}
+		j++
+	}
+	m := float64(matches)
+	jaro := (m/float64(len(s)) + m/float64(len(t)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < 4 && prefix < len(s) && prefix < len(t) && s[prefix] == t[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+//fuzzyTags are the normalised artist, album and title of a row
+type fuzzyTags struct {
+	artist, album, title string
+}
+
+//similarity is how alike two rows' tags are; that of their least alike tag
+func (f fuzzyTags) similarity(o fuzzyTags) float64 {
+	score := 1.0
+	for _, pair := range [][2]string{{f.artist, o.artist}, {f.album, o.album}, {f.title, o.title}} {
+		if s := jaroWinkler(pair[0], pair[1]); s < score {
+			score = s
+		}
+	}
+	return score
+}
+
+//block is what two rows must share to be compared at all; the first letter of their artist and of their title
+func (f fuzzyTags) block() string {
+	first := func(s string) string {
+		for _, r := range s {
+			return string(r)
+		}
+		return ""
+	}
+	return first(f.artist) + "\x00" + first(f.title)
+}
+
+/*matchFuzzyTags lists groups of files in scanned_files whose tags match once
+normalised, or nearly match, in fuzzy_candidates, with the score of the
+least alike pair that joined each group.  The groups are left for review
+rather than resolved, as tags alone can mislead.  The table is rebuilt on
+every run.*/
+func (fdb *FileDB) matchFuzzyTags(ctx context.Context) error {
+	if fdb.fuzzyAt <= 0 {
+		return nil
+	}
+	rows := []*FileEntry{}
+	fdb.mutex.Lock()
+	err := fdb.db.Select(&rows, `SELECT id, path, artist, album, title FROM scanned_files WHERE title IS NOT NULL AND artist IS NOT NULL`)
+	fdb.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	blocks := map[string][]int{}
+	tags := make([]fuzzyTags, len(rows))
+	for i, r := range rows {
+		tags[i] = fuzzyTags{normaliseTag(r.Artist.String), normaliseTag(r.Album.String), normaliseTag(r.Title.String)}
+		blocks[tags[i].block()] = append(blocks[tags[i].block()], i)
+	}
+
+	parent := make([]int, len(rows))
+	score := make([]float64, len(rows)) //lowest score joining each root's group
+	for i := range parent {
+		parent[i], score[i] = i, 1
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for _, members := range blocks {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		for x, i := range members {
+			for _, j := range members[x+1:] {
+				s := tags[i].similarity(tags[j])
+				if s < fdb.fuzzyAt {
+					continue
+				}
+				ri, rj := find(i), find(j)
+				if ri != rj {
+					parent[ri] = rj
+					score[rj] = minFloat(score[rj], score[ri])
+				}
+				score[rj] = minFloat(score[rj], s)
+			}
+		}
+	}
+
+	groups := map[int][]int{}
+	for i := range rows {
+		groups[find(i)] = append(groups[find(i)], i)
+	}
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	tx, err := fdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM fuzzy_candidates`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	now, n := time.Now().Unix(), 0
+	for root, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+		n++
+		sort.Slice(members, func(a, b int) bool { return rows[members[a]].ID.Int64 < rows[members[b]].ID.Int64 })
+		group := rows[members[0]].ID.Int64
+		for _, i := range members {
+			r := rows[i]
+			if _, err := tx.Exec(`INSERT INTO fuzzy_candidates (group_id, file_id, path, artist, album, title, score, found_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				group, r.ID.Int64, r.Path.String, r.Artist, r.Album, r.Title, score[root], now); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Found %d groups of files whose tags nearly match; see fuzzy_candidates\n", n)
+	return nil
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,54 @@
+package hasher
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormaliseTag(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"The Beatles", "beatles the"},
+		{"Beatles, The", "beatles the"},
+		{"Hey Jude (Remastered 2009)", "hey jude"},
+		{"Hey Jude [Live]", "hey jude"},
+		{"Song (feat. Someone)", "song"},
+		{"Song (Acoustic)", "song acoustic"},
+		{"Beyoncé", "beyonce"},
+		{"A Tribe Called Quest", "tribe called quest a"},
+		{"An Evening", "evening an"},
+		{"Theory", "theory"},
+		{"AC/DC", "ac dc"},
+		{"  ", ""},
+	}
+	for _, tt := range tests {
+		if got := normaliseTag(tt.in); got != tt.want {
+			t.Errorf("normaliseTag(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestJaroWinkler(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"", "", 1},
+		{"abc", "", 0},
+		{"abc", "abc", 1},
+		{"abc", "xyz", 0},
+		{"martha", "marhta", 0.961},
+		{"dwayne", "duane", 0.840},
+		{"dixon", "dicksonx", 0.813},
+		{"beatles the", "beatles the", 1},
+	}
+	for _, tt := range tests {
+		if got := jaroWinkler(tt.a, tt.b); math.Abs(got-tt.want) > 0.001 {
+			t.Errorf("jaroWinkler(%q, %q) = %.3f, want %.3f", tt.a, tt.b, got, tt.want)
+		}
+		if got, back := jaroWinkler(tt.a, tt.b), jaroWinkler(tt.b, tt.a); math.Abs(got-back) > 1e-9 {
+			t.Errorf("jaroWinkler(%q, %q) = %.3f but the other way round is %.3f", tt.a, tt.b, got, back)
+		}
+	}
+}
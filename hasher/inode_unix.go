@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package hasher
+
+import (
+	"os"
+	"syscall"
+)
+
+//inode returns the inode number backing info, if the platform has one
+func inode(info os.FileInfo) (uint64, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino), true
+	}
+	return 0, false
+}
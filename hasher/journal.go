@@ -0,0 +1,202 @@
+package hasher
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//journalEntry is a row in operations; one step of a journaled run such as move
+type journalEntry struct {
+	ID          sql.NullInt64  `db:"id"`
+	OpID        sql.NullInt64  `db:"op_id"`
+	Kind        sql.NullString `db:"kind"`
+	CreatedAt   sql.NullInt64  `db:"created_at"`
+	FileID      sql.NullInt64  `db:"file_id"`
+	Source      sql.NullString `db:"source"`
+	Destination sql.NullString `db:"destination"`
+	Status      sql.NullString `db:"status"`
+}
+
+func (*journalEntry) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS operations (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, op_id INTEGER, kind TEXT, created_at INTEGER, file_id INTEGER, source TEXT, destination TEXT, status TEXT)`
+}
+
+//nextOperation allocates the id the entries of a new run are journaled under
+func (fdb *FileDB) nextOperation() (int64, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	op := int64(0)
+	err := fdb.db.Get(&op, `SELECT COALESCE(MAX(op_id), 0) + 1 FROM operations`)
+	return op, err
+}
+
+/*journal records a step of operation op before it is carried out, returning
+the entry id so its status can be updated afterwards*/
+func (fdb *FileDB) journal(op int64, kind string, fileID int64, source, destination, status string) (int64, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	res, err := fdb.db.Exec(`INSERT INTO operations (op_id, kind, created_at, file_id, source, destination, status) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		op, kind, time.Now().Unix(), fileID, source, destination, status)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (fdb *FileDB) setJournalStatus(id int64, status string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	_, err := fdb.db.Exec(`UPDATE operations SET status = ? WHERE id = ?`, status, id)
+	return err
+}
+
+//missingDirs lists, outermost first, the directories that must be created to hold path
+func missingDirs(path string) []string {
+	dirs := []string{}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		dirs = append([]string{dir}, dirs...)
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	return dirs
+}
+
+/*Undo reverses operation op: moved files are put back where they came from,
+their rows are returned from moved to scanned_files, files that were moved
+aside to make way for them are put back, and the directories the run created
+are removed if they are empty.  Anything that cannot be reversed
+is reported as a conflict and left in place.*/
+func (fdb *FileDB) Undo(op int64) error {
+	entries := []journalEntry{}
+	fdb.mutex.Lock()
+	err := fdb.db.Select(&entries, `SELECT * FROM operations WHERE op_id = ? ORDER BY id DESC`, op)
+	fdb.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no operation %d in the journal", op)
+	}
+
+	conflicts := 0
+	conflict := func(e journalEntry, why string, args ...interface{}) error {
+		conflicts++
+		fmt.Printf("* [conflict] %s\n", fmt.Sprintf(why, args...))
+		if fdb.dryRun {
+			return nil
+		}
+		return fdb.setJournalStatus(e.ID.Int64, "conflict")
+	}
+
+	for _, e := range entries {
+		src, dst := e.Source.String, e.Destination.String
+		var err error
+		switch {
+		case e.Kind.String == "mkdir" && e.Status.String == "done":
+			err = fdb.undoMkdir(e, conflict)
+		case (e.Kind.String == "move" || e.Kind.String == "sidecar") && (e.Status.String == "done" || e.Status.String == "copied" || e.Status.String == "pending"):
+			_, srcErr := os.Stat(src)
+			_, dstErr := os.Stat(dst)
+			switch {
+			case e.Status.String == "pending" && srcErr == nil && os.IsNotExist(dstErr):
+				continue //never happened
+			case srcErr == nil:
+				err = conflict(e, "%s exists again; leaving %s where it is", src, dst)
+			case dstErr != nil:
+				err = conflict(e, "%s is gone; cannot put it back at %s", dst, src)
+			case fdb.dryRun:
+				fmt.Printf("* [dry-run] would move %s -> %s\n", dst, src)
+			default:
+				err = fdb.undoMove(e)
+			}
+		case e.Kind.String == "replace" && e.Status.String == "done":
+			_, destErr := os.Stat(src)
+			_, asideErr := os.Stat(dst)
+			switch {
+			case destErr == nil:
+				err = conflict(e, "%s is taken again; leaving the file it replaced at %s", src, dst)
+			case asideErr != nil:
+				err = conflict(e, "%s is gone; cannot put it back at %s", dst, src)
+			case fdb.dryRun:
+				fmt.Printf("* [dry-run] would move %s -> %s\n", dst, src)
+			default:
+				err = fdb.undoReplace(e)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Undo of operation %d finished with %d conflicts\n", op, conflicts)
+	return nil
+}
+
+func (fdb *FileDB) undoMkdir(e journalEntry, conflict func(journalEntry, string, ...interface{}) error) error {
+	dir := e.Destination.String
+	if fdb.dryRun {
+		fmt.Printf("* [dry-run] would remove directory %s\n", dir)
+		return nil
+	}
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return conflict(e, "cannot remove directory %s: %v", dir, err)
+	}
+	return fdb.setJournalStatus(e.ID.Int64, "undone")
+}
+
+func (fdb *FileDB) undoMove(e journalEntry) error {
+	src, dst := e.Source.String, e.Destination.String
+	if err := os.MkdirAll(filepath.Dir(src), os.ModePerm); err != nil {
+		return err
+	}
+	if _, err := moveFile(dst, src, ""); err != nil {
+		return err
+	}
+	fmt.Printf("* restored %s\n", src)
+	if e.Kind.String == "sidecar" {
+		if err := fdb.sidecarMoved(dst, src); err != nil {
+			return err
+		}
+		return fdb.setJournalStatus(e.ID.Int64, "undone")
+	}
+
+	fdb.mutex.Lock()
+	tx := fdb.db.MustBegin()
+	tx.MustExec(`INSERT INTO scanned_files (`+columnList(true)+`) SELECT `+columnList(true)+` FROM moved WHERE id=? AND id NOT IN (SELECT id FROM scanned_files)`, e.FileID.Int64)
+	tx.MustExec(`DELETE FROM moved WHERE id=?`, e.FileID.Int64)
+	tx.MustExec(`UPDATE operations SET status = 'undone' WHERE id = ?`, e.ID.Int64)
+	err := tx.Commit()
+	fdb.mutex.Unlock()
+	return err
+}
+
+/*undoReplace puts back a file that overwrite-if-better moved aside, and its
+row back where it was before it was made a duplicate.*/
+func (fdb *FileDB) undoReplace(e journalEntry) error {
+	dest, aside, id := e.Source.String, e.Destination.String, e.FileID.Int64
+	if _, err := moveFile(aside, dest, ""); err != nil {
+		return err
+	}
+	fmt.Printf("* restored %s\n", dest)
+
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	tx := fdb.db.MustBegin()
+	if id != 0 {
+		table, path := libraryTable(tx, id, dest)
+		tx.MustExec(`INSERT INTO `+table+` (`+columnList(true)+`) SELECT `+columnList(true)+` FROM duplicates WHERE id = ?`, id)
+		tx.MustExec(`UPDATE `+table+` SET path = ? WHERE id = ?`, path, id)
+		tx.MustExec(`DELETE FROM duplicates WHERE id = ?`, id)
+		tx.MustExec(`DELETE FROM dup_members WHERE group_id IN (SELECT group_id FROM dup_members WHERE file_id = ? AND role = '`+roleToss+`') AND group_id IN (SELECT id FROM dup_groups WHERE stage = '`+byMoveConflict+`' AND rule = ?)`, id, replacedRule(dest))
+		tx.MustExec(`DELETE FROM dup_groups WHERE stage = '`+byMoveConflict+`' AND rule = ? AND id NOT IN (SELECT group_id FROM dup_members)`, replacedRule(dest))
+	}
+	tx.MustExec(`UPDATE operations SET status = 'undone' WHERE id = ?`, e.ID.Int64)
+	return tx.Commit()
+}
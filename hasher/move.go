@@ -0,0 +1,145 @@
+package hasher
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+//verifiedCopy is a row in verified_copies; a cross-device move that was copied and checked before the source was removed
+type verifiedCopy struct {
+	ID          sql.NullInt64  `db:"id"`
+	OpID        sql.NullInt64  `db:"op_id"`
+	FileID      sql.NullInt64  `db:"file_id"`
+	Source      sql.NullString `db:"source"`
+	Destination sql.NullString `db:"destination"`
+	XxHash      sql.NullString `db:"xxhash"`
+	CopiedAt    sql.NullInt64  `db:"copied_at"`
+}
+
+func (*verifiedCopy) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS verified_copies (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, op_id INTEGER, file_id INTEGER, source TEXT, destination TEXT, xxhash TEXT, copied_at INTEGER)`
+}
+
+//recordCopy notes that r was moved to dest by a verified copy
+func (fdb *FileDB) recordCopy(op int64, r *FileEntry, dest string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	_, err := fdb.db.Exec(`INSERT INTO verified_copies (op_id, file_id, source, destination, xxhash, copied_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		op, r.ID.Int64, r.Path.String, dest, r.XxHash.String, time.Now().Unix())
+	return err
+}
+
+func isCrossDevice(err error) bool {
+	var le *os.LinkError
+	return errors.As(err, &le) && le.Err == syscall.EXDEV
+}
+
+/*hashAsScanned fills in XxHash for a file assemble never hashed in full,
+refusing with Skipped if its size, modification time, inode or partial hash
+show it is no longer the file that was scanned.*/
+func (r *FileEntry) hashAsScanned() error {
+	f, err := os.Open(r.Path.String)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !r.Unchanged(info) {
+		return fromE("%s has changed since it was scanned", r.Path.String)
+	}
+	if r.PartialHash.Valid {
+		partial, err := hashRanges(f, headTail([]byteRange{{0, info.Size()}}, partialSpan))
+		if err != nil {
+			return err
+		}
+		if partial != r.PartialHash.String {
+			return fromE("%s has changed since it was scanned", r.Path.String)
+		}
+	}
+	return r.xxhash(f)
+}
+
+/*moveFile renames src to dst, returning true if it had to copy because they
+are on different filesystems.  See copyVerified.*/
+func moveFile(src, dst, want string) (bool, error) {
+	err := os.Rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return false, err
+	}
+	return true, copyVerified(src, dst, want)
+}
+
+/*copyVerified copies src into a temporary file beside dst and syncs it, then
+reads it back and checks its xxhash against both the source as it was read and
+want (the hash recorded at scan time, if not empty).  Only once it matches is
+it given src's permissions and mtime, renamed into place, and src removed.*/
+func copyVerified(src, dst, want string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".part")
+	if err != nil {
+		return err
+	}
+	done := false
+	defer func() {
+		if !done {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	source, copied := &FileEntry{}, &FileEntry{}
+	if err := source.xxhash(in); err != nil {
+		return err
+	}
+	if err := copied.xxhash(tmp); err != nil {
+		return err
+	}
+	if copied.XxHash.String != source.XxHash.String || (want != "" && copied.XxHash.String != want) {
+		return fmt.Errorf("copy of %s does not match: source %s, copy %s, recorded %s", src, source.XxHash.String, copied.XxHash.String, want)
+	}
+
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	done = true
+	if dir, err := os.Open(filepath.Dir(dst)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return os.Remove(src)
+}
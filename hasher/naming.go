@@ -0,0 +1,141 @@
+package hasher
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+/*DefaultFormat is the layout move uses unless told otherwise:
+<Artist>/<Album>/<NN Title><ext>*/
+const DefaultFormat = `{{or .Artist "Unknown"}}/{{or .Album "Unknown"}}/{{pad 2 .TrackNo}} {{or .Title "Unknown"}}{{.Extension}}`
+
+/*NameFields are the FileEntry fields a format template can use, with the NULLs
+flattened to empty strings and zeros*/
+type NameFields struct {
+	Path, Filename, Extension, Format, FileType               string
+	Title, Album, Artist, AlbumArtist, Composer, Genre, Codec string
+	Year, TrackNo, TrackTotal, DiskNo, DiskTotal, Bitrate     int64
+}
+
+//Fields flattens r for use in a format template
+func (r *FileEntry) Fields() NameFields {
+	return NameFields{
+		Path: r.Path.String, Filename: r.Filename.String, Extension: r.Extension.String,
+		Format: r.Format.String, FileType: r.FileType.String,
+		Title: r.Title.String, Album: r.Album.String, Artist: r.Artist.String, AlbumArtist: r.AlbumArtist.String,
+		Composer: r.Composer.String, Genre: r.Genre.String, Codec: r.Codec.String,
+		Year: r.Year.Int64, TrackNo: r.TrackNo.Int64, TrackTotal: r.TrackTotal.Int64,
+		DiskNo: r.DiskNo.Int64, DiskTotal: r.DiskTotal.Int64, Bitrate: r.Bitrate.Int64,
+	}
+}
+
+var variousArtists = map[string]bool{"various": true, "various artists": true, "va": true, "v.a.": true, "compilation": true}
+
+//Compilation returns true if the album artist marks this as a various artists compilation
+func (f NameFields) Compilation() bool {
+	return variousArtists[strings.ToLower(strings.TrimSpace(f.AlbumArtist))]
+}
+
+var nameFuncs = template.FuncMap{
+	//pad zero pads n to width digits: {{pad 2 .TrackNo}}
+	"pad": func(width int, n int64) string {
+		return fmt.Sprintf("%0*d", width, n)
+	},
+	//albumArtist is "Various Artists" for compilations, else the album artist, falling back to the artist
+	"albumArtist": func(f NameFields) string {
+		switch {
+		case f.Compilation():
+			return "Various Artists"
+		case f.AlbumArtist != "":
+			return f.AlbumArtist
+		case f.Artist != "":
+			return f.Artist
+		}
+		return "Unknown"
+	},
+	//disc is a "Disc N/" subfolder for multi-disc albums, and nothing otherwise
+	"disc": func(f NameFields) string {
+		if f.DiskTotal > 1 || f.DiskNo > 1 {
+			return fmt.Sprintf("Disc %d/", f.DiskNo)
+		}
+		return ""
+	},
+	//yearPrefix is "<year> - ", or nothing when the year is unknown
+	"yearPrefix": func(year int64) string {
+		if year > 0 {
+			return fmt.Sprintf("%d - ", year)
+		}
+		return ""
+	},
+	//letter is the upper case first letter of s ignoring a leading "The ", or "#" if it does not start with one
+	"letter": func(s string) string {
+		if len(s) > 4 && strings.EqualFold(s[:4], "the ") {
+			s = s[4:]
+		}
+		if c := []rune(s); len(c) > 0 && unicode.IsLetter(c[0]) {
+			return string(unicode.ToUpper(c[0]))
+		}
+		return "#"
+	},
+}
+
+//A Namer builds the path, relative to the move destination, a file is moved to
+type Namer struct {
+	tmpl  *template.Template
+	clean *Sanitizer
+}
+
+/*NewNamer parses a text/template format over NameFields.  "/" separates
+directories.  Besides the text/template builtins (eg {{or .AlbumArtist .Artist}})
+it can use pad, albumArtist, disc, yearPrefix and letter.  For example:
+
+	{{albumArtist .}}/{{yearPrefix .Year}}{{.Album}}/{{.DiskNo}}-{{pad 2 .TrackNo}} {{.Title}}{{.Extension}}
+
+Names are made safe for the filesystem profile (see Sanitizers): the field
+values before they are substituted, so "AC/DC" stays one directory, and then
+each directory and file name that results.
+*/
+func NewNamer(format, profile string) (*Namer, error) {
+	clean, err := SanitizerFor(profile)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("name").Funcs(nameFuncs).Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	//catch references to fields that do not exist now, not once per file
+	if err := tmpl.Execute(ioutil.Discard, NameFields{}); err != nil {
+		return nil, err
+	}
+	return &Namer{tmpl: tmpl, clean: clean}, nil
+}
+
+var defaultNamer, _ = NewNamer(DefaultFormat, "posix")
+
+//Name renders the name for r; it refuses names that are empty or would escape the destination
+func (n *Namer) Name(r *FileEntry) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := n.tmpl.Execute(buf, n.clean.Fields(r.Fields())); err != nil {
+		return "", err
+	}
+	parts := []string{}
+	for _, part := range strings.Split(buf.String(), "/") {
+		part = strings.TrimSpace(part)
+		if part == ".." {
+			return "", fmt.Errorf("%q climbs out of the destination", buf.String())
+		}
+		if part != "" && part != "." {
+			parts = append(parts, n.clean.Component(part))
+		}
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("format produced an empty name for %s", r.Path.String)
+	}
+	return filepath.Join(parts...), nil
+}
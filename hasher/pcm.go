@@ -0,0 +1,200 @@
+package hasher
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+//errNoDecoder is returned by decodePCM for codecs there is no decoder for, such as AAC or ALAC
+var errNoDecoder = errors.New("no decoder for codec")
+
+/*pcmDecoders turn a file into interleaved 16-bit stereo, returning the
+stream and its sample rate, keyed by the codec column.*/
+var pcmDecoders = map[string]func(f *os.File, size int64) (io.Reader, int, error){
+	"mp3": decodeMP3,
+}
+
+//decodeMP3 decodes an MPEG layer III stream, leaving out any tags around it, or the frames of one in an MP4 container
+func decodeMP3(f *os.File, size int64) (io.Reader, int, error) {
+	ranges := mp3Payload(f, size)
+	if isMP4(f) {
+		samples, err := mp4AudioTrack(f, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		ranges = samples
+	}
+	readers := []io.Reader{}
+	for _, rg := range ranges {
+		readers = append(readers, io.NewSectionReader(f, rg.start, rg.end-rg.start))
+	}
+	//not an io.Seeker, or the decoder reads the whole file up front to find its length
+	dec, err := mp3.NewDecoder(io.MultiReader(readers...))
+	if err != nil {
+		return nil, 0, err
+	}
+	return dec, dec.SampleRate(), nil
+}
+
+/*mp4AudioTrack returns where each sample, one coded frame apiece, of the
+first sound track in an MP4 file lies.*/
+func mp4AudioTrack(f io.ReaderAt, size int64) ([]byteRange, error) {
+	moov, ok := mp4Find(f, 0, size, "moov")
+	if !ok {
+		return nil, errors.New("no moov box")
+	}
+	stbl, ok := mp4SoundTrack(f, moov)
+	if !ok {
+		return nil, errors.New("no sound track")
+	}
+	return mp4Samples(f, stbl)
+}
+
+//mp4MaxSamples bounds how many samples a track may claim, so a corrupt stsz cannot exhaust memory
+const mp4MaxSamples = 1 << 24
+
+/*mp4Samples lists where each sample of a track lies, in order, from the stsz,
+stsc and stco or co64 boxes in its stbl.*/
+func mp4Samples(f io.ReaderAt, stbl mp4Box) ([]byteRange, error) {
+	read := func(typ string) []byte {
+		box, ok := mp4Find(f, stbl.start, stbl.end, typ)
+		if !ok || box.end-box.start < 8 {
+			return nil
+		}
+		b := make([]byte, box.end-box.start)
+		if _, err := f.ReadAt(b, box.start); err != nil {
+			return nil
+		}
+		return b
+	}
+	be := binary.BigEndian
+
+	stsz := read("stsz")
+	if len(stsz) < 12 {
+		return nil, errors.New("no stsz box")
+	}
+	fixed, count := int64(be.Uint32(stsz[4:])), int(be.Uint32(stsz[8:]))
+	if count > mp4MaxSamples || (fixed == 0 && 12+4*count > len(stsz)) {
+		return nil, errors.New("bad stsz box")
+	}
+	sizes := make([]int64, count)
+	for i := range sizes {
+		sizes[i] = fixed
+		if fixed == 0 {
+			sizes[i] = int64(be.Uint32(stsz[12+4*i:]))
+		}
+	}
+
+	chunks := []int64{}
+	if stco := read("stco"); stco != nil {
+		for i := 8; i+4 <= len(stco) && len(chunks) < int(be.Uint32(stco[4:])); i += 4 {
+			chunks = append(chunks, int64(be.Uint32(stco[i:])))
+		}
+	} else if co64 := read("co64"); co64 != nil {
+		for i := 8; i+8 <= len(co64) && len(chunks) < int(be.Uint32(co64[4:])); i += 8 {
+			chunks = append(chunks, int64(be.Uint64(co64[i:])))
+		}
+	} else {
+		return nil, errors.New("no stco or co64 box")
+	}
+
+	stsc := read("stsc")
+	if stsc == nil {
+		return nil, errors.New("no stsc box")
+	}
+	entries := int(be.Uint32(stsc[4:]))
+	if 8+12*entries > len(stsc) {
+		return nil, errors.New("bad stsc box")
+	}
+	samples := make([]byteRange, 0, count)
+	for e := 0; e < entries; e++ {
+		first, last := int(be.Uint32(stsc[8+12*e:]))-1, len(chunks)
+		if e+1 < entries {
+			last = int(be.Uint32(stsc[8+12*(e+1):])) - 1
+		}
+		per := int(be.Uint32(stsc[8+12*e+4:]))
+		for c := first; c >= 0 && c < last && c < len(chunks); c++ {
+			off := chunks[c]
+			for k := 0; k < per && len(samples) < count; k++ {
+				samples = append(samples, byteRange{off, off + sizes[len(samples)]})
+				off += sizes[len(samples)-1]
+			}
+		}
+	}
+	return samples, nil
+}
+
+/*decodePCM decodes the first fingerprintSeconds of path to mono samples at
+fingerprintRate.*/
+func decodePCM(path, codec string) ([]float64, error) {
+	decode, ok := pcmDecoders[codec]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errNoDecoder, codec)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	stream, rate, err := decode(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if rate <= 0 {
+		return nil, fmt.Errorf("bad sample rate %d", rate)
+	}
+
+	mono := make([]float64, 0, fingerprintSeconds*rate)
+	buf := make([]byte, 4<<10)
+	for len(mono) < fingerprintSeconds*rate {
+		n, err := io.ReadFull(stream, buf)
+		for i := 0; i+4 <= n; i += 4 {
+			l := int16(binary.LittleEndian.Uint16(buf[i:]))
+			r := int16(binary.LittleEndian.Uint16(buf[i+2:]))
+			mono = append(mono, (float64(l)+float64(r))/2)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resample(mono, rate, fingerprintRate), nil
+}
+
+/*resample converts samples from one rate to another, averaging over the
+span of input behind each output sample so higher frequencies do not fold
+back down.*/
+func resample(samples []float64, from, to int) []float64 {
+	if from == to {
+		return samples
+	}
+	ratio := float64(from) / float64(to)
+	out := make([]float64, int(float64(len(samples))/ratio))
+	for i := range out {
+		start := int(float64(i) * ratio)
+		end := int(float64(i+1) * ratio)
+		if end <= start {
+			end = start + 1
+		}
+		if end > len(samples) {
+			end = len(samples)
+		}
+		sum := 0.0
+		for _, s := range samples[start:end] {
+			sum += s
+		}
+		out[i] = sum / float64(end-start)
+	}
+	return out
+}
@@ -0,0 +1,145 @@
+package hasher
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*Policy ranks the members of a duplicate set so Resolve can pick the one to
+keep without asking.  Rules are applied in order; each one narrows the set to
+the members that score best on it, until a single member is left.
+
+An example policy file:
+
+	rules:
+	  - prefer: lossless
+	  - prefer: bitrate
+	  - prefer: path
+	    paths: [/music/flac, /music/itunes]
+	  - prefer: tags
+	  - prefer: oldest
+*/
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+/*Rule is a single ranking criterion.  Prefer is one of:
+* lossless    - lossless codecs over lossy ones
+* bitrate     - highest bitrate
+* sample_rate - highest sample rate
+* path        - paths under the earliest listed prefix in Paths
+* tags        - most tag fields filled in
+* oldest      - oldest modification time
+* newest      - newest modification time
+* largest     - largest file
+*/
+type Rule struct {
+	Prefer string   `yaml:"prefer"`
+	Paths  []string `yaml:"paths"`
+}
+
+var losslessCodecs = map[string]bool{"alac": true, "flac": true, "wav": true, "aiff": true, "ape": true, "wv": true}
+var losslessExtensions = map[string]bool{".flac": true, ".wav": true, ".aif": true, ".aiff": true, ".ape": true, ".wv": true}
+
+//score returns how well r meets the rule; higher is better
+func (rule Rule) score(r *FileEntry) int64 {
+	b := func(v bool) int64 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	switch rule.Prefer {
+	case "lossless":
+		return b(losslessCodecs[r.Codec.String] || losslessExtensions[r.Extension.String])
+	case "bitrate":
+		return r.Bitrate.Int64
+	case "sample_rate":
+		return r.SampleRate.Int64
+	case "path":
+		for i, prefix := range rule.Paths {
+			if strings.HasPrefix(r.Path.String, prefix) {
+				return int64(len(rule.Paths) - i)
+			}
+		}
+		return 0
+	case "tags":
+		n := int64(0)
+		for _, s := range []sql.NullString{r.Title, r.Album, r.Artist, r.AlbumArtist, r.Composer, r.Genre, r.Comment} {
+			n += b(s.Valid && s.String != "")
+		}
+		for _, i := range []sql.NullInt64{r.Year, r.TrackNo, r.TrackTotal, r.DiskNo, r.DiskTotal} {
+			n += b(i.Valid && i.Int64 > 0)
+		}
+		return n
+	case "oldest", "newest":
+		if !r.Mtime.Valid {
+			return math.MinInt64 //unknown, so never preferred
+		}
+		if rule.Prefer == "oldest" {
+			return -r.Mtime.Int64
+		}
+		return r.Mtime.Int64
+	case "largest":
+		return r.Size.Int64
+	}
+	return 0
+}
+
+//LoadPolicy reads a YAML policy file
+func LoadPolicy(path string) (*Policy, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(raw, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, rule := range p.Rules {
+		switch rule.Prefer {
+		case "lossless", "bitrate", "sample_rate", "tags", "oldest", "newest", "largest":
+		case "path":
+			if len(rule.Paths) == 0 {
+				return nil, fmt.Errorf("%s: rule %d prefers path but lists no paths", path, i+1)
+			}
+		default:
+			return nil, fmt.Errorf("%s: rule %d has unknown preference %q", path, i+1, rule.Prefer)
+		}
+	}
+	return p, nil
+}
+
+/*Rank applies the rules in order and returns the members of d that are left.
+A single member is the winner; more than one means the policy ended in a tie.*/
+func (p *Policy) Rank(d Duplicates) Duplicates {
+	best := d
+	for _, rule := range p.Rules {
+		if len(best) < 2 {
+			break
+		}
+		top := best[0]
+		for _, r := range best[1:] {
+			if rule.score(r) > rule.score(top) {
+				top = r
+			}
+		}
+		left := Duplicates{}
+		for _, r := range best {
+			if rule.score(r) == rule.score(top) {
+				left = append(left, r)
+			}
+		}
+		if len(left) == 1 {
+			log.Printf("Policy kept %s (prefer %s)\n", left[0].Path.String, rule.Prefer)
+		}
+		best = left
+	}
+	return best
+}
@@ -0,0 +1,54 @@
+package hasher
+
+import (
+	"database/sql"
+	"testing"
+)
+
+//mtimes makes a set of files with the given modification times; -1 is unknown
+func mtimes(ts ...int64) Duplicates {
+	d := Duplicates{}
+	for i, t := range ts {
+		r := &FileEntry{ID: sql.NullInt64{Int64: int64(i), Valid: true}}
+		if t >= 0 {
+			r.Mtime = sql.NullInt64{Int64: t, Valid: true}
+		}
+		d = append(d, r)
+	}
+	return d
+}
+
+func TestRankByMtime(t *testing.T) {
+	tests := []struct {
+		prefer string
+		d      Duplicates
+		want   []int64
+	}{
+		{"oldest", mtimes(200, 100, 300), []int64{1}},
+		{"newest", mtimes(200, 100, 300), []int64{2}},
+		{"oldest", mtimes(-1, 100, 200), []int64{1}},
+		{"newest", mtimes(-1, 100, 200), []int64{2}},
+		{"oldest", mtimes(100, -1), []int64{0}},
+		{"newest", mtimes(100, -1), []int64{0}},
+		{"oldest", mtimes(0, -1), []int64{0}},
+		{"oldest", mtimes(-1, -1), []int64{0, 1}},
+		{"oldest", mtimes(100, 100, 200), []int64{0, 1}},
+	}
+	for n, tt := range tests {
+		p := &Policy{Rules: []Rule{{Prefer: tt.prefer}}}
+		got := []int64{}
+		for _, r := range p.Rank(tt.d) {
+			got = append(got, r.ID.Int64)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("case %d: prefer %s kept %v, want %v", n, tt.prefer, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("case %d: prefer %s kept %v, want %v", n, tt.prefer, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package hasher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/cespare/xxhash"
+)
+
+//The hash_state of a row
+const (
+	hashLazy = "lazy" //xxhash or audio_hash were not needed yet, so may be NULL
+	hashFull = "full" //both were computed
+)
+
+//SetFullHashing has assemble hash every file in full as it reads it, rather than only those that might be duplicates
+func (fdb *FileDB) SetFullHashing(on bool) {
+	fdb.fullHash = on
+}
+
+//partialSpan is how much of each end of a file the partial hashes cover
+const partialSpan = 64 << 10
+
+//spanLength is the number of bytes covered by ranges
+func spanLength(ranges []byteRange) int64 {
+	n := int64(0)
+	for _, rg := range ranges {
+		n += rg.end - rg.start
+	}
+	return n
+}
+
+//headTail cuts ranges down to their first and last n bytes, or leaves them be if that is all of them
+func headTail(ranges []byteRange, n int64) []byteRange {
+	if spanLength(ranges) <= 2*n {
+		return ranges
+	}
+	take := func(ranges []byteRange, n int64, fromEnd bool) []byteRange {
+		out := []byteRange{}
+		for i := range ranges {
+			rg := ranges[i]
+			if fromEnd {
+				rg = ranges[len(ranges)-1-i]
+			}
+			if n <= 0 {
+				break
+			}
+			if l := rg.end - rg.start; l > n {
+				if fromEnd {
+					rg.start = rg.end - n
+				} else {
+					rg.end = rg.start + n
+				}
+			}
+			n -= rg.end - rg.start
+			if fromEnd {
+				out = append([]byteRange{rg}, out...)
+			} else {
+				out = append(out, rg)
+			}
+		}
+		return out
+	}
+	return append(take(ranges, n, false), take(ranges, n, true)...)
+}
+
+//hashRanges is the xxhash of the bytes of file in ranges, taken in order
+func hashRanges(file *os.File, ranges []byteRange) (string, error) {
+	dig := xxhash.New()
+	pooled := readBuffers.Get().(*[]byte)
+	defer readBuffers.Put(pooled)
+	for _, rg := range ranges {
+		if _, err := io.CopyBuffer(dig, io.NewSectionReader(file, rg.start, rg.end-rg.start), *pooled); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%d", dig.Sum64()), nil
+}
+
+/*A hashPass fills in one hash column for the scanned_files rows that need it:
+those whose group columns are shared with another row, so could be duplicates.
+spans picks which bytes of the file are hashed.*/
+type hashPass struct {
+	column string
+	group  string
+	spans  func(file *os.File, size int64) []byteRange
+}
+
+var hashPasses = []hashPass{
+	{"partial_hash", "size", func(f *os.File, size int64) []byteRange {
+		return headTail([]byteRange{{0, size}}, partialSpan)
+	}},
+	{"xxhash", "size, partial_hash", func(f *os.File, size int64) []byteRange {
+		return []byteRange{{0, size}}
+	}},
+	{"partial_audio_hash", "audio_size", func(f *os.File, size int64) []byteRange {
+		return headTail(audioPayload(f, size), partialSpan)
+	}},
+	{"audio_hash", "audio_size, partial_audio_hash", func(f *os.File, size int64) []byteRange {
+		return audioPayload(f, size)
+	}},
+}
+
+/*completeHashes works out the hashes assemble put off, the way fdupes does.
+Files are grouped by size first, as almost every file's is unique.  Those that
+share a size have the first and last 64 KiB of them hashed, and only those
+still colliding after that are hashed in full.  The audio payload hashes are
+done the same way, grouped by the payload's size.
+
+Rows are left with hash_state "lazy" if either full hash was never needed.*/
+func (fdb *FileDB) completeHashes(ctx context.Context, goroutines int) error {
+	if err := fdb.backfillAudioSize(); err != nil {
+		return err
+	}
+	for _, pass := range hashPasses {
+		if err := fdb.hashPass(ctx, pass, goroutines); err != nil {
+			return err
+		}
+	}
+	_, err := fdb.Exec(`UPDATE scanned_files SET hash_state = CASE
+		WHEN xxhash IS NOT NULL AND (audio_hash IS NOT NULL OR audio_size IS NULL) THEN '` + hashFull + `'
+		ELSE '` + hashLazy + `' END`)
+	return err
+}
+
+/*backfillAudioSize fills in audio_size for rows scanned before it existed,
+recognisable by having no hash_state, so they can be grouped with new rows*/
+func (fdb *FileDB) backfillAudioSize() error {
+	old := []*FileEntry{}
+	fdb.mutex.Lock()
+	err := fdb.db.Select(&old, `SELECT id, path, size FROM scanned_files WHERE hash_state IS NULL AND audio_size IS NULL`)
+	fdb.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, r := range old {
+		file, err := os.Open(r.Path.String)
+		if err != nil {
+			fdb.scanError(r.Path.String, stageRead, err)
+			continue
+		}
+		payload := audioPayload(file, r.Size.Int64)
+		file.Close()
+		if payload == nil {
+			continue
+		}
+		fdb.mutex.Lock()
+		_, err = fdb.db.Exec(`UPDATE scanned_files SET audio_size = ? WHERE id = ?`, spanLength(payload), r.ID.Int64)
+		fdb.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fdb *FileDB) hashPass(ctx context.Context, pass hashPass, goroutines int) error {
+	todo := []*FileEntry{}
+	fdb.mutex.Lock()
+	err := fdb.db.Select(&todo, fmt.Sprintf(`SELECT id, path, size FROM scanned_files
+		WHERE %[1]s IS NULL AND (%[2]s) IN (SELECT %[2]s FROM scanned_files GROUP BY %[2]s HAVING count(*) > 1)`, pass.column, pass.group))
+	fdb.mutex.Unlock()
+	if err != nil || len(todo) == 0 {
+		return err
+	}
+	log.Printf("Computing %s for %d files that might be duplicates\n", pass.column, len(todo))
+
+	type hashed struct {
+		id   int64
+		hash string
+	}
+	work := make(chan *FileEntry)
+	done := make(chan hashed, len(todo))
+	wg := &sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				h, err := pass.hash(r)
+				if err != nil {
+					fdb.scanError(r.Path.String, stageRead, err)
+					continue
+				}
+				if h != "" {
+					done <- hashed{r.ID.Int64, h}
+				}
+			}
+		}()
+	}
+	for _, r := range todo {
+		if ctx.Err() != nil {
+			break
+		}
+		work <- r
+	}
+	close(work)
+	wg.Wait()
+	close(done)
+
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	tx, err := fdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	for h := range done {
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE scanned_files SET %s = ? WHERE id = ?`, pass.column), h.hash, h.id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+//hash returns the hash of r's file for this pass, or "" if it has no such span
+func (pass hashPass) hash(r *FileEntry) (string, error) {
+	file, err := os.Open(r.Path.String)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	spans := pass.spans(file, r.Size.Int64)
+	if spans == nil {
+		return "", nil
+	}
+	return hashRanges(file, spans)
+}
@@ -0,0 +1,33 @@
+package hasher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHeadTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []byteRange
+		n      int64
+		want   []byteRange
+	}{
+		{"empty", []byteRange{}, 4, []byteRange{}},
+		{"shorter than both ends", []byteRange{{0, 6}}, 4, []byteRange{{0, 6}}},
+		{"exactly both ends", []byteRange{{0, 8}}, 4, []byteRange{{0, 8}}},
+		{"one range", []byteRange{{0, 100}}, 4, []byteRange{{0, 4}, {96, 100}}},
+		{"offset range", []byteRange{{10, 110}}, 4, []byteRange{{10, 14}, {106, 110}}},
+		{"ends within first and last ranges", []byteRange{{0, 10}, {20, 30}, {40, 50}}, 4, []byteRange{{0, 4}, {46, 50}}},
+		{"ends spanning ranges", []byteRange{{0, 3}, {10, 20}, {30, 32}}, 5, []byteRange{{0, 3}, {10, 12}, {17, 20}, {30, 32}}},
+		{"ends filling whole ranges", []byteRange{{0, 4}, {10, 20}, {30, 34}}, 4, []byteRange{{0, 4}, {30, 34}}},
+	}
+	for _, tt := range tests {
+		got := headTail(tt.ranges, tt.n)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: headTail(%v, %d) = %v, want %v", tt.name, tt.ranges, tt.n, got, tt.want)
+		}
+		if len(tt.ranges) > 0 && spanLength(tt.ranges) > 2*tt.n && spanLength(got) != 2*tt.n {
+			t.Errorf("%s: headTail covers %d bytes, want %d", tt.name, spanLength(got), 2*tt.n)
+		}
+	}
+}
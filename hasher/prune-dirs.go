@@ -0,0 +1,152 @@
+package hasher
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//prunedDir is a row in pruned_dirs; a directory removed by PruneDirs, along with the junk that was in it
+type prunedDir struct {
+	ID       sql.NullInt64  `db:"id"`
+	Root     sql.NullString `db:"root"`
+	Path     sql.NullString `db:"path"`
+	Junk     sql.NullString `db:"junk"`
+	PrunedAt sql.NullInt64  `db:"pruned_at"`
+}
+
+func (*prunedDir) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS pruned_dirs (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, root TEXT, path TEXT, junk TEXT, pruned_at INTEGER)`
+}
+
+func scanRootsCreateStmt() string {
+	return `CREATE TABLE IF NOT EXISTS scan_roots (path TEXT NOT NULL PRIMARY KEY, scanned_at INTEGER)`
+}
+
+//recordScanRoot remembers that root was assembled, so PruneDirs knows how far up it may go
+func (fdb *FileDB) recordScanRoot(root string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	_, err := fdb.db.Exec(`INSERT OR REPLACE INTO scan_roots (path, scanned_at) VALUES (?, ?)`, root, time.Now().Unix())
+	return err
+}
+
+//within returns true if path is root or lies below it
+func within(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+/*PruneDirs removes the directories under root that are empty, or that hold
+nothing but files badApple ignores such as .DS_Store and desktop.ini.  It works
+bottom-up, so a folder left empty by pruning its children goes too, but root
+itself is always kept.  If root is empty every assembled root is pruned;
+otherwise root must lie inside one of them.
+
+Each directory removed is logged in pruned_dirs.*/
+func (fdb *FileDB) PruneDirs(root string) error {
+	scanned := []string{}
+	fdb.mutex.Lock()
+	err := fdb.db.Select(&scanned, `SELECT path FROM scan_roots ORDER BY path`)
+	fdb.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	roots := scanned
+	if root != "" {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		inside := false
+		for _, s := range scanned {
+			inside = inside || within(abs, s)
+		}
+		if !inside {
+			return fmt.Errorf("%s is not inside any assembled root; prune-dirs never goes above them", abs)
+		}
+		roots = []string{abs}
+	}
+
+	for _, r := range roots {
+		n, err := fdb.pruneUnder(r)
+		if err != nil {
+			return err
+		}
+		log.Printf("Pruned %d directories under %s\n", n, r)
+	}
+	return nil
+}
+
+func (fdb *FileDB) pruneUnder(root string) (int, error) {
+	dirs := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	//Walk is lexical and parents come before children, so backwards is bottom-up
+	gone := map[string]bool{}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return len(gone), err
+		}
+		junk := []string{}
+		keep := false
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			switch {
+			case gone[p]:
+			case e.Mode().IsRegular() && badApple(p):
+				junk = append(junk, e.Name())
+			default:
+				keep = true
+			}
+		}
+		if keep {
+			continue
+		}
+
+		gone[dir] = true
+		if fdb.dryRun {
+			fmt.Printf("* [dry-run] would remove directory %s\n", dir)
+			continue
+		}
+		for _, j := range junk {
+			if err := os.Remove(filepath.Join(dir, j)); err != nil {
+				return len(gone), err
+			}
+		}
+		if err := os.Remove(dir); err != nil {
+			return len(gone), err
+		}
+		fmt.Printf("* removed directory %s\n", dir)
+		fdb.mutex.Lock()
+		_, err = fdb.db.Exec(`INSERT INTO pruned_dirs (root, path, junk, pruned_at) VALUES (?, ?, ?, ?)`,
+			root, dir, strings.Join(junk, "\n"), time.Now().Unix())
+		fdb.mutex.Unlock()
+		if err != nil {
+			return len(gone), err
+		}
+	}
+	return len(gone), nil
+}
@@ -0,0 +1,24 @@
+package hasher
+
+import "testing"
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		path, root string
+		want       bool
+	}{
+		{"/music", "/music", true},
+		{"/music/A", "/music", true},
+		{"/music/A/B", "/music", true},
+		{"/musicals", "/music", false},
+		{"/", "/music", false},
+		{"/other", "/music", false},
+		{"/music/../etc", "/music", false},
+		{"/anything", "/", true},
+	}
+	for _, tt := range tests {
+		if got := within(tt.path, tt.root); got != tt.want {
+			t.Errorf("within(%q, %q) = %v, want %v", tt.path, tt.root, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package hasher
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//quarantinedFile is a row in quarantined
+type quarantinedFile struct {
+	ID             sql.NullInt64  `db:"id"`
+	FileID         sql.NullInt64  `db:"file_id"`
+	OriginalPath   sql.NullString `db:"original_path"`
+	QuarantinePath sql.NullString `db:"quarantine_path"`
+	QuarantinedAt  sql.NullInt64  `db:"quarantined_at"`
+	Status         sql.NullString `db:"status"`
+}
+
+func (*quarantinedFile) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS quarantined (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, file_id INTEGER, original_path TEXT, quarantine_path TEXT, quarantined_at INTEGER, status TEXT)`
+}
+
+//mirrorPath returns where path lands when mirrored under root
+func mirrorPath(root, path string) string {
+	vol := filepath.VolumeName(path)
+	return filepath.Join(root, strings.Replace(vol, ":", "", -1), path[len(vol):])
+}
+
+//Quarantine moves the file into a tree mirroring its absolute path under dir, returning where it went
+func (r *FileEntry) Quarantine(dir string) (string, error) {
+	if !r.Path.Valid {
+		return "", fromE("No path")
+	}
+	st, err := os.Stat(r.Path.String)
+	if err != nil || !st.Mode().IsRegular() {
+		fmt.Printf("* [Gone?] %s\n", r.Path.String)
+		return "", fromE("Appears to not exist on file system: %v", err)
+	}
+	dest := mirrorPath(dir, r.Path.String)
+	if _, err := os.Stat(dest); err == nil {
+		return "", fromE("Already something quarantined at %s", dest)
+	}
+	fmt.Printf("* quarantine %s\n", r.Path.String)
+	_, err = r.MoveTo(dest)
+	return dest, err
+}
+
+/*quarantineDups moves everything listed in duplicates, except those already
+replaced by links, under dir, recording each move in quarantined so it can be
+restored or purged later.*/
+func (fdb *FileDB) quarantineDups(ctx context.Context, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	dups := []*FileEntry{}
+	fdb.mutex.Lock()
+	err = fdb.db.Select(&dups, `SELECT id, path, size, mtime, inode, partial_hash, xxhash FROM duplicates WHERE `+unlinked)
+	fdb.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, dup := range dups {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fdb.dryRun {
+			fmt.Printf("* [dry-run] would quarantine %s -> %s\n", dup.Path.String, mirrorPath(dir, dup.Path.String))
+			continue
+		}
+		dest, err := dup.Quarantine(dir)
+		switch err.(type) {
+		case nil:
+		case Skipped:
+			continue
+		default:
+			return err
+		}
+
+		fdb.mutex.Lock()
+		_, err = fdb.db.Exec(`INSERT INTO quarantined (file_id, original_path, quarantine_path, quarantined_at, status) VALUES (?, ?, ?, ?, 'quarantined')`,
+			dup.ID.Int64, dup.Path.String, dest, time.Now().Unix())
+		fdb.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fdb *FileDB) quarantined(where string, args ...interface{}) ([]quarantinedFile, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	q := []quarantinedFile{}
+	err := fdb.db.Select(&q, `SELECT * FROM quarantined WHERE status = 'quarantined' AND `+where, args...)
+	return q, err
+}
+
+func (fdb *FileDB) setQuarantineStatus(id int64, status string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	_, err := fdb.db.Exec(`UPDATE quarantined SET status = ? WHERE id = ?`, status, id)
+	return err
+}
+
+/*Restore moves quarantined files back to their original paths.  If under is
+not empty, only files originally beneath it are restored.  Files whose original
+path has since been taken are left in quarantine.
+
+A restored file is no longer a duplicate: its row goes back from duplicates
+into scanned_files, so dup-nuke leaves it alone and analyze looks at it again.*/
+func (fdb *FileDB) Restore(under string) error {
+	where, args := `1`, []interface{}{}
+	if under != "" {
+		abs, err := filepath.Abs(under)
+		if err != nil {
+			return err
+		}
+		prefix := dirPrefix(abs)
+		where, args = `(original_path = ? OR substr(original_path, 1, length(?)) = ?)`, []interface{}{abs, prefix, prefix}
+	}
+	files, err := fdb.quarantined(where, args...)
+	if err != nil {
+		return err
+	}
+	for _, q := range files {
+		if _, err := os.Stat(q.OriginalPath.String); err == nil {
+			log.Printf("Not restoring %s: something else is there now\n", q.OriginalPath.String)
+			continue
+		}
+		if fdb.dryRun {
+			fmt.Printf("* [dry-run] would restore %s\n", q.OriginalPath.String)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(q.OriginalPath.String), os.ModePerm); err != nil {
+			return err
+		}
+		if _, err := moveFile(q.QuarantinePath.String, q.OriginalPath.String, ""); err != nil {
+			return err
+		}
+		fmt.Printf("* restored %s\n", q.OriginalPath.String)
+		if err := fdb.unquarantined(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//unquarantined marks q restored, and returns its row from duplicates to scanned_files
+func (fdb *FileDB) unquarantined(q quarantinedFile) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	tx := fdb.db.MustBegin()
+	tx.MustExec(`UPDATE quarantined SET status = 'restored' WHERE id = ?`, q.ID.Int64)
+	tx.MustExec(`INSERT INTO scanned_files (`+columnList(true)+`) SELECT `+columnList(true)+` FROM duplicates WHERE id = ? AND id NOT IN (SELECT id FROM scanned_files)`, q.FileID.Int64)
+	tx.MustExec(`DELETE FROM duplicates WHERE id = ?`, q.FileID.Int64)
+	tx.MustExec(`UPDATE dup_members SET role = '`+roleUndecided+`', decided_by = NULL WHERE file_id = ? AND role = '`+roleToss+`'`, q.FileID.Int64)
+	return tx.Commit()
+}
+
+/*Purge permanently removes files that have been in quarantine for at least olderThan*/
+func (fdb *FileDB) Purge(olderThan time.Duration) error {
+	files, err := fdb.quarantined(`quarantined_at <= ?`, time.Now().Add(-olderThan).Unix())
+	if err != nil {
+		return err
+	}
+	for _, q := range files {
+		if fdb.dryRun {
+			fmt.Printf("* [dry-run] would remove %s\n", q.QuarantinePath.String)
+			continue
+		}
+		if err := os.Remove(q.QuarantinePath.String); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Printf("* bye-bye %s\n", q.QuarantinePath.String)
+		if err := fdb.setQuarantineStatus(q.ID.Int64, "purged"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
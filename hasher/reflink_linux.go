@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package hasher
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+//dedupeChunk is how much is asked of FIDEDUPERANGE at once; filesystems cap a single call anyway
+const dedupeChunk = 16 << 20
+
+//fileDedupeRange issues FIDEDUPERANGE; a variable so tests can stand in for the kernel
+var fileDedupeRange = unix.IoctlFileDedupeRange
+
+//dedupeRange has the kernel share src's extents with dst, which must have the same contents, returning the bytes deduped
+func dedupeRange(src, dst *os.File, size int64) (int64, error) {
+	done := int64(0)
+	for done < size {
+		length := size - done
+		if length > dedupeChunk {
+			length = dedupeChunk
+		}
+		r := &unix.FileDedupeRange{
+			Src_offset: uint64(done),
+			Src_length: uint64(length),
+			Info:       []unix.FileDedupeRangeInfo{{Dest_fd: int64(dst.Fd()), Dest_offset: uint64(done)}},
+		}
+		if err := fileDedupeRange(int(src.Fd()), r); err != nil {
+			return done, reflinkError(err)
+		}
+		info := r.Info[0]
+		switch {
+		case info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			return done, fmt.Errorf("contents differ at offset %d", done)
+		case info.Status < 0:
+			return done, reflinkError(syscall.Errno(-info.Status))
+		case info.Bytes_deduped == 0:
+			return done, fmt.Errorf("no progress at offset %d", done)
+		}
+		done += int64(info.Bytes_deduped)
+	}
+	return done, nil
+}
+
+//reflinkError marks the errors a filesystem gives when it cannot share extents at all
+func reflinkError(err error) error {
+	switch err {
+	case unix.EOPNOTSUPP, unix.ENOTTY, unix.EINVAL, unix.EXDEV:
+		return errReflinkUnsupported
+	}
+	return err
+}
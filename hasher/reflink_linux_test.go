@@ -0,0 +1,257 @@
+package hasher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+//dedupeCall is what one FIDEDUPERANGE was asked to do
+type dedupeCall struct {
+	srcOffset, length, destOffset uint64
+}
+
+//stubDedupe has dedupeRange call kernel instead of FIDEDUPERANGE until the test ends, recording each call
+func stubDedupe(t *testing.T, kernel func(call int, r *unix.FileDedupeRange) error) *[]dedupeCall {
+	calls := &[]dedupeCall{}
+	saved := fileDedupeRange
+	t.Cleanup(func() { fileDedupeRange = saved })
+	fileDedupeRange = func(srcFd int, r *unix.FileDedupeRange) error {
+		*calls = append(*calls, dedupeCall{r.Src_offset, r.Src_length, r.Info[0].Dest_offset})
+		return kernel(len(*calls)-1, r)
+	}
+	return calls
+}
+
+//tempFiles creates files in dir with the given contents, removing them when the test ends
+func tempFiles(t *testing.T, dir string, contents ...[]byte) []*os.File {
+	files := []*os.File{}
+	for _, b := range contents {
+		f, err := ioutil.TempFile(dir, "reflink")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close(); os.Remove(f.Name()) })
+		if _, err := f.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+func TestDedupeRangeChunks(t *testing.T) {
+	const c, m = dedupeChunk, 10 << 20
+	size := int64(2*c + 1000)
+	tests := []struct {
+		name  string
+		most  uint64 //the most a call dedupes, as filesystems cap it; 0 for all it is asked
+		calls []dedupeCall
+	}{
+		{"whole chunks", 0, []dedupeCall{{0, c, 0}, {c, c, c}, {2 * c, 1000, 2 * c}}},
+		{"capped by the filesystem", m, []dedupeCall{{0, c, 0}, {m, c, m}, {2 * m, uint64(size) - 2*m, 2 * m}, {3 * m, uint64(size) - 3*m, 3 * m}}},
+	}
+	for _, tt := range tests {
+		files := tempFiles(t, "", []byte("src"), []byte("dst"))
+		calls := stubDedupe(t, func(_ int, r *unix.FileDedupeRange) error {
+			r.Info[0].Bytes_deduped = r.Src_length
+			if tt.most > 0 && r.Src_length > tt.most {
+				r.Info[0].Bytes_deduped = tt.most
+			}
+			r.Info[0].Status = unix.FILE_DEDUPE_RANGE_SAME
+			return nil
+		})
+		got, err := dedupeRange(files[0], files[1], size)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if got != size {
+			t.Errorf("%s: deduped %d bytes, want %d", tt.name, got, size)
+		}
+		if !reflect.DeepEqual(*calls, tt.calls) {
+			t.Errorf("%s: called with %v, want %v", tt.name, *calls, tt.calls)
+		}
+	}
+}
+
+func TestDedupeRangeErrors(t *testing.T) {
+	const c = dedupeChunk
+	tests := []struct {
+		name        string
+		kernel      func(call int, r *unix.FileDedupeRange) error
+		done        int64
+		unsupported bool
+	}{
+		{"not supported", func(int, *unix.FileDedupeRange) error { return unix.EOPNOTSUPP }, 0, true},
+		{"not a regular filesystem", func(int, *unix.FileDedupeRange) error { return unix.ENOTTY }, 0, true},
+		{"across filesystems", func(int, *unix.FileDedupeRange) error { return unix.EXDEV }, 0, true},
+		{"refused by status", func(_ int, r *unix.FileDedupeRange) error {
+			r.Info[0].Status = -int32(unix.EOPNOTSUPP)
+			return nil
+		}, 0, true},
+		{"i/o error", func(int, *unix.FileDedupeRange) error { return unix.EIO }, 0, false},
+		{"differs part way", func(call int, r *unix.FileDedupeRange) error {
+			if call == 1 {
+				r.Info[0].Status = unix.FILE_DEDUPE_RANGE_DIFFERS
+				return nil
+			}
+			r.Info[0].Bytes_deduped = r.Src_length
+			return nil
+		}, c, false},
+		{"no progress", func(int, *unix.FileDedupeRange) error { return nil }, 0, false},
+	}
+	for _, tt := range tests {
+		files := tempFiles(t, "", []byte("src"), []byte("dst"))
+		stubDedupe(t, tt.kernel)
+		done, err := dedupeRange(files[0], files[1], 2*c)
+		switch {
+		case err == nil:
+			t.Errorf("%s: no error", tt.name)
+		case (err == errReflinkUnsupported) != tt.unsupported:
+			t.Errorf("%s: error %v, unsupported should be %v", tt.name, err, tt.unsupported)
+		}
+		if done != tt.done {
+			t.Errorf("%s: deduped %d bytes, want %d", tt.name, done, tt.done)
+		}
+	}
+}
+
+//reflinkedDuplicate sets up a database in dir holding keep.mp3 and dup.mp3, a duplicate of it with the same contents
+func reflinkedDuplicate(t *testing.T, dir string, contents []byte) *FileDB {
+	fdb := CreateFileDB(filepath.Join(dir, "test.db"))
+	t.Cleanup(func() { fdb.Close() })
+	for _, name := range []string{"keep.mp3", "dup.mp3"} {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewFileEntry(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fdb.Insert(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fdb.MustExecMany([]string{
+		`INSERT INTO duplicates (` + columnList(true) + `, duplicate_of) SELECT ` + columnList(true) + `, '1' FROM scanned_files WHERE id = 2`,
+		`DELETE FROM scanned_files WHERE id = 2`,
+	})
+	return fdb
+}
+
+func TestDupReflinkerRecordsBytes(t *testing.T) {
+	contents := bytes.Repeat([]byte("music"), 1000)
+	tests := []struct {
+		name   string
+		kernel func(call int, r *unix.FileDedupeRange) error
+		want   []int64
+	}{
+		{"shared", func(_ int, r *unix.FileDedupeRange) error {
+			r.Info[0].Bytes_deduped = r.Src_length
+			return nil
+		}, []int64{int64(len(contents))}},
+		{"unsupported", func(int, *unix.FileDedupeRange) error { return unix.EOPNOTSUPP }, []int64{}},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "dup-reflink")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		fdb := reflinkedDuplicate(t, dir, contents)
+		stubDedupe(t, tt.kernel)
+		if err := fdb.DupReflinker(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := []int64{}
+		if err := fdb.db.Select(&got, `SELECT bytes FROM reflinked`); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: reflinked %v bytes, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+//filesystems without FIDEDUPERANGE support, by statfs magic
+var noDedupe = map[int64]string{unix.TMPFS_MAGIC: "tmpfs", unix.EXT4_SUPER_MAGIC: "ext4"}
+
+func TestDedupeRangeUnsupportedFilesystem(t *testing.T) {
+	tried := 0
+	for _, dir := range []string{os.TempDir(), "/dev/shm"} {
+		st := unix.Statfs_t{}
+		if err := unix.Statfs(dir, &st); err != nil {
+			continue
+		}
+		fs, ok := noDedupe[int64(st.Type)]
+		if !ok {
+			continue
+		}
+		tried++
+		contents := bytes.Repeat([]byte("music"), 1000)
+		files := tempFiles(t, dir, contents, contents)
+		if _, err := dedupeRange(files[0], files[1], int64(len(contents))); err != errReflinkUnsupported {
+			t.Errorf("%s on %s: got %v, want %v", dir, fs, err, errReflinkUnsupported)
+		}
+	}
+	if tried == 0 {
+		t.Skip("no tmpfs or ext4 to try")
+	}
+}
+
+/*TestDedupeRangeBtrfs shares the blocks of two files on a Btrfs image
+mounted on a loop device, so it needs root and mkfs.btrfs.*/
+func TestDedupeRangeBtrfs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount a loop device")
+	}
+	if _, err := exec.LookPath("mkfs.btrfs"); err != nil {
+		t.Skip("needs mkfs.btrfs")
+	}
+	dir, err := ioutil.TempDir("", "btrfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image, mnt := filepath.Join(dir, "btrfs.img"), filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, 128<<20); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range [][]string{{"mkfs.btrfs", "-q", image}, {"mount", "-o", "loop", image, mnt}} {
+		if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+			t.Skipf("%s: %v: %s", cmd[0], err, out)
+		}
+	}
+	defer exec.Command("umount", mnt).Run()
+
+	contents := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(contents)
+	files := tempFiles(t, mnt, contents, contents)
+	for _, f := range files {
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := dedupeRange(files[0], files[1], int64(len(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != int64(len(contents)) {
+		t.Errorf("deduped %d bytes, want %d", got, len(contents))
+	}
+	differs := tempFiles(t, mnt, contents, append([]byte{contents[0] + 1}, contents[1:]...))
+	if _, err := dedupeRange(differs[0], differs[1], int64(len(contents))); err == nil || err == errReflinkUnsupported {
+		t.Errorf("files that differ: got %v, want contents differ", err)
+	}
+}
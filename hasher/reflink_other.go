@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package hasher
+
+import "os"
+
+//dedupeRange has the kernel share src's extents with dst; only Linux has FIDEDUPERANGE
+func dedupeRange(src, dst *os.File, size int64) (int64, error) {
+	return 0, errReflinkUnsupported
+}
@@ -0,0 +1,148 @@
+package hasher
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+//ErrReviewPaused is returned by Prune when the user quits at the prompt; the decisions made so far are kept
+var ErrReviewPaused = errors.New("review paused; run analyze --resume to carry on where it left off")
+
+//SetResume has Prune carry on the last review that was paused, from the first set it had not decided, rather than starting again
+func (fdb *FileDB) SetResume(on bool) {
+	fdb.resume = on
+}
+
+/*reviewSession is a row in review_sessions; one run of analyze, the stage it
+has reached, and whether it is running, paused, done, or was superseded by
+a later run.*/
+type reviewSession struct {
+	ID        sql.NullInt64  `db:"id"`
+	StartedAt sql.NullInt64  `db:"started_at"`
+	UpdatedAt sql.NullInt64  `db:"updated_at"`
+	Stage     sql.NullString `db:"stage"`
+	Status    sql.NullString `db:"status"`
+}
+
+func (*reviewSession) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS review_sessions (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, started_at INTEGER, updated_at INTEGER, stage TEXT, status TEXT)`
+}
+
+/*startReview begins a review session, returning its id and the stage to
+start from; "" for the first.  When resuming, it picks up the last session
+that did not finish.*/
+func (fdb *FileDB) startReview() (int64, string, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	now := time.Now().Unix()
+	if fdb.resume {
+		last := reviewSession{}
+		err := fdb.db.Get(&last, `SELECT * FROM review_sessions WHERE status IN ('running', 'paused') ORDER BY id DESC LIMIT 1`)
+		switch {
+		case err == nil:
+			log.Printf("Resuming the review started %s, at the %s stage\n", time.Unix(last.StartedAt.Int64, 0).Format(time.RFC1123), last.Stage.String)
+			fdb.resuming, fdb.reviewStarted = last.Stage.String, last.StartedAt.Int64
+			_, err = fdb.db.Exec(`UPDATE review_sessions SET status = 'running', updated_at = ? WHERE id = ?`, now, last.ID.Int64)
+			return last.ID.Int64, last.Stage.String, err
+		case err != sql.ErrNoRows:
+			return 0, "", err
+		}
+		log.Println("No paused review to resume; starting from the beginning")
+	}
+	if _, err := fdb.db.Exec(`UPDATE review_sessions SET status = 'superseded', updated_at = ? WHERE status IN ('running', 'paused')`, now); err != nil {
+		return 0, "", err
+	}
+	res, err := fdb.db.Exec(`INSERT INTO review_sessions (started_at, updated_at, stage, status) VALUES (?, ?, '', 'running')`, now, now)
+	if err != nil {
+		return 0, "", err
+	}
+	id, err := res.LastInsertId()
+	return id, "", err
+}
+
+/*decidedEarlier returns true if stage is the one being resumed and the review
+already recorded a decision for the group it found under rule, so the group
+is not asked about again.*/
+func (fdb *FileDB) decidedEarlier(stage, rule string) (bool, error) {
+	if fdb.resuming == "" || stage != fdb.resuming {
+		return false, nil
+	}
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	n := 0
+	err := fdb.db.Get(&n, `SELECT count(*) FROM dup_groups WHERE stage = ? AND rule = ? AND created_at >= ? AND id IN (SELECT group_id FROM dup_members WHERE role != '`+roleUndecided+`')`,
+		stage, rule, fdb.reviewStarted)
+	return n > 0, err
+}
+
+//updateReview records the stage session is at and its status
+func (fdb *FileDB) updateReview(session int64, stage, status string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	_, err := fdb.db.Exec(`UPDATE review_sessions SET stage = ?, status = ?, updated_at = ? WHERE id = ?`, stage, status, time.Now().Unix(), session)
+	return err
+}
+
+//comparisonFor is the FileEntryComparison the stage resolves its groups with
+func comparisonFor(stage string) FileEntryComparison {
+	switch stage {
+	case byHash:
+		return SameExceptPath
+	case byAudioHash:
+		return SameAudio
+	}
+	return nil
+}
+
+/*undoLastDecision takes back the choice most recently made at the prompt:
+the tossed files go back into scanned_files and every member of the group is
+undecided again.  It returns the group and its members, or nil if there is
+nothing to undo.  Choices whose tossed files have since been removed cannot
+be undone.*/
+func (fdb *FileDB) undoLastDecision() (*dupGroup, Duplicates, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	g := &dupGroup{}
+	err := fdb.db.Get(g, `SELECT * FROM dup_groups WHERE id IN (SELECT group_id FROM dup_members WHERE decided_by = '`+decidedUser+`') ORDER BY id DESC LIMIT 1`)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	tossed := Duplicates{}
+	if err := fdb.db.Select(&tossed, `SELECT `+columnList(true)+` FROM duplicates WHERE id IN (SELECT file_id FROM dup_members WHERE group_id = ? AND role = '`+roleToss+`')`, g.ID.Int64); err != nil {
+		return nil, nil, err
+	}
+	for _, r := range tossed {
+		if _, err := os.Lstat(r.Path.String); err != nil {
+			return nil, nil, fmt.Errorf("cannot undo group #%d: %s is gone", g.ID.Int64, r.Path.String)
+		}
+	}
+
+	tx, err := fdb.db.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, stmt := range []string{
+		`INSERT INTO scanned_files (` + columnList(true) + `) SELECT ` + columnList(true) + ` FROM duplicates WHERE id IN (SELECT file_id FROM dup_members WHERE group_id = ? AND role = '` + roleToss + `')`,
+		`DELETE FROM duplicates WHERE id IN (SELECT file_id FROM dup_members WHERE group_id = ? AND role = '` + roleToss + `')`,
+		`UPDATE dup_members SET role = '` + roleUndecided + `', decided_by = NULL WHERE group_id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, g.ID.Int64); err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	members := Duplicates{}
+	err = fdb.db.Select(&members, `SELECT * FROM scanned_files WHERE id IN (SELECT file_id FROM dup_members WHERE group_id = ?) ORDER BY id`, g.ID.Int64)
+	return g, members, err
+}
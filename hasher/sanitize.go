@@ -0,0 +1,110 @@
+package hasher
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*A Sanitizer makes single path components safe to create on a particular kind
+of filesystem.  Names are normalised to NFC, reserved and control characters
+are replaced with "_", and components are cut down to MaxBytes.*/
+type Sanitizer struct {
+	Reserved      string //characters that may not appear in a component
+	TrimTrailing  bool   //strip trailing dots and spaces
+	ReservedNames bool   //avoid the DOS device names; CON, PRN, AUX, NUL, COM1-9, LPT1-9
+	MaxBytes      int    //longest component allowed
+}
+
+/*windows is the profile for names Windows will accept.  They are limited to
+255 UTF-16 code units, which 255 bytes of UTF-8 never exceeds.*/
+var windows = &Sanitizer{Reserved: `<>:"/\|?*`, TrimTrailing: true, ReservedNames: true, MaxBytes: 255}
+
+/*Sanitizers are the selectable profiles, by name.  FAT32 volumes and SMB
+shares take the same names as Windows, so fat32 and smb are aliases for it.*/
+var Sanitizers = map[string]*Sanitizer{
+	"posix":   {Reserved: "/", MaxBytes: 255},
+	"windows": windows,
+	"fat32":   windows,
+	"smb":     windows,
+}
+
+//SanitizerFor looks up a profile by name
+func SanitizerFor(profile string) (*Sanitizer, error) {
+	if s, ok := Sanitizers[profile]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown filesystem profile %q", profile)
+}
+
+var dosDevices = map[string]bool{"CON": true, "PRN": true, "AUX": true, "NUL": true}
+
+func init() {
+	for i := 1; i <= 9; i++ {
+		dosDevices[fmt.Sprintf("COM%d", i)] = true
+		dosDevices[fmt.Sprintf("LPT%d", i)] = true
+	}
+}
+
+//replace swaps reserved and control characters for "_"
+func (s *Sanitizer) replace(name string) string {
+	return strings.Map(func(c rune) rune {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(s.Reserved, c) {
+			return '_'
+		}
+		return c
+	}, norm.NFC.String(name))
+}
+
+//Value sanitizes a tag value before it is put into a name, so a "/" in a title cannot start a new directory
+func (s *Sanitizer) Value(v string) string {
+	v = s.replace(v)
+	if v == "." || v == ".." {
+		return strings.Repeat("_", len(v))
+	}
+	return v
+}
+
+//Component makes name safe to use as a single file or directory name
+func (s *Sanitizer) Component(name string) string {
+	name = strings.TrimSpace(s.replace(name))
+	if s.TrimTrailing {
+		name = strings.TrimRight(name, ". ")
+	}
+	if s.ReservedNames {
+		base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+		if dosDevices[strings.TrimSpace(base)] {
+			name = "_" + name
+		}
+	}
+	if len(name) > s.MaxBytes {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 || len(ext) >= s.MaxBytes {
+			ext = ""
+		}
+		base := name[:s.MaxBytes-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+		if s.TrimTrailing {
+			name = strings.TrimRight(strings.TrimSuffix(name, ext), ". ") + ext
+		}
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+//Fields sanitizes every string in f with Value
+func (s *Sanitizer) Fields(f NameFields) NameFields {
+	for _, v := range []*string{&f.Path, &f.Filename, &f.Extension, &f.Format, &f.FileType,
+		&f.Title, &f.Album, &f.Artist, &f.AlbumArtist, &f.Composer, &f.Genre, &f.Codec} {
+		*v = s.Value(*v)
+	}
+	return f
+}
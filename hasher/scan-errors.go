@@ -0,0 +1,115 @@
+package hasher
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+//scanError is a row in scan_errors; a path assemble could not walk, read or store
+type scanError struct {
+	ID        sql.NullInt64  `db:"id"`
+	Path      sql.NullString `db:"path"`
+	Stage     sql.NullString `db:"stage"`
+	Class     sql.NullString `db:"class"`
+	Message   sql.NullString `db:"message"`
+	ScannedAt sql.NullInt64  `db:"scanned_at"`
+}
+
+func (*scanError) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS scan_errors (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, path TEXT, stage TEXT, class TEXT, message TEXT, scanned_at INTEGER)`
+}
+
+//The stages of a scan an error can happen in
+const (
+	stageWalk  = "walk"  //listing a directory or stating an entry
+	stageRead  = "read"  //opening, hashing and parsing a file
+	stageStore = "store" //writing its row
+)
+
+//errorClass sorts err into a broad kind, so scan_errors can be summarised
+func errorClass(err error) string {
+	var sqlErr sqlite3.Error
+	var errno syscall.Errno
+	switch {
+	case os.IsPermission(err):
+		return "permission"
+	case os.IsNotExist(err):
+		return "not-found"
+	case errors.As(err, &sqlErr):
+		return "database"
+	case errors.As(err, &errno) && errno == syscall.EIO:
+		return "io"
+	case strings.HasPrefix(err.Error(), "panic: "):
+		return "unparseable"
+	}
+	return "other"
+}
+
+//ScanErrors is returned by PopulateDB when some paths could not be scanned; they are listed in scan_errors
+type ScanErrors struct {
+	Count   int
+	ByClass map[string]int
+}
+
+func (e ScanErrors) Error() string {
+	classes := []string{}
+	for class, n := range e.ByClass {
+		classes = append(classes, fmt.Sprintf("%d %s", n, class))
+	}
+	sort.Strings(classes)
+	return fmt.Sprintf("%d paths could not be scanned (%s); see the scan_errors table", e.Count, strings.Join(classes, ", "))
+}
+
+//scanError records that path could not be scanned, and logs it
+func (fdb *FileDB) scanError(path, stage string, err error) {
+	class := errorClass(err)
+	log.Printf("✗: %s: %s error: %v\n", path, class, err)
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	if _, dberr := fdb.db.Exec(`INSERT INTO scan_errors (path, stage, class, message, scanned_at) VALUES (?, ?, ?, ?, ?)`,
+		path, stage, class, err.Error(), time.Now().Unix()); dberr != nil {
+		log.Printf("Could not record error for %s: %v\n", path, dberr)
+	}
+}
+
+//clearScanErrors forgets the errors from earlier scans of root, as they are about to be retried
+func (fdb *FileDB) clearScanErrors(root string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	prefix := dirPrefix(root)
+	_, err := fdb.db.Exec(`DELETE FROM scan_errors WHERE path = ? OR substr(path, 1, length(?)) = ?`, root, prefix, prefix)
+	return err
+}
+
+//scanErrors summarises the errors recorded under root, returning nil if there were none
+func (fdb *FileDB) scanErrors(root string) error {
+	rows := []struct {
+		Class string `db:"class"`
+		N     int    `db:"n"`
+	}{}
+	fdb.mutex.Lock()
+	prefix := dirPrefix(root)
+	err := fdb.db.Select(&rows, `SELECT class, count(*) AS n FROM scan_errors WHERE path = ? OR substr(path, 1, length(?)) = ? GROUP BY class`, root, prefix, prefix)
+	fdb.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	e := ScanErrors{ByClass: map[string]int{}}
+	for _, r := range rows {
+		e.Count += r.N
+		e.ByClass[r.Class] = r.N
+	}
+	return e
+}
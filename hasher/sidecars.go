@@ -0,0 +1,188 @@
+package hasher
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//sidecarExtensions are the files that belong with the tracks beside them, rather than being music themselves
+var sidecarExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".bmp": true, ".webp": true,
+	".pdf": true, ".lrc": true, ".cue": true, ".nfo": true, ".log": true,
+}
+
+func isSidecar(path string) bool {
+	return sidecarExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+/*sidecar is a row in sidecars.  Base is the filename without its extension,
+used to tie eg "01 Song.lrc" to "01 Song.mp3".*/
+type sidecar struct {
+	ID   sql.NullInt64  `db:"id"`
+	Path sql.NullString `db:"path"`
+	Dir  sql.NullString `db:"dir"`
+	Base sql.NullString `db:"base"`
+}
+
+func (*sidecar) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS sidecars (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, path TEXT UNIQUE, dir TEXT, base TEXT)`
+}
+
+func basename(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+//recordSidecars replaces the sidecars known under root with paths
+func (fdb *FileDB) recordSidecars(root string, paths []string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	prefix := dirPrefix(root)
+	tx := fdb.db.MustBegin()
+	tx.MustExec(`DELETE FROM sidecars WHERE substr(path, 1, length(?)) = ?`, prefix, prefix)
+	for _, p := range paths {
+		tx.MustExec(`INSERT OR REPLACE INTO sidecars (path, dir, base) VALUES (?, ?, ?)`, p, filepath.Dir(p), basename(p))
+	}
+	return tx.Commit()
+}
+
+/*moveSidecars follows a move run, taking the sidecars of each source directory
+along with its tracks.  files are all the rows the run considered, and moved
+maps the ids of those that moved to where they went.
+
+A sidecar named after a track goes wherever that track went, renamed to match.
+The rest, such as cover.jpg or a booklet, only move if every track in their
+directory moved, and all to the same folder; tracks in missing_tags, rejects
+or duplicates that are still there hold them back too.*/
+func (fdb *FileDB) moveSidecars(op int64, files []*FileEntry, moved map[int64]string) error {
+	type dirState struct {
+		tracks map[string]*FileEntry
+		dests  map[string]bool
+	}
+	dirs := map[string]*dirState{}
+	for _, f := range files {
+		dir := filepath.Dir(f.Path.String)
+		st, ok := dirs[dir]
+		if !ok {
+			st = &dirState{tracks: map[string]*FileEntry{}, dests: map[string]bool{}}
+			dirs[dir] = st
+		}
+		st.tracks[basename(f.Path.String)] = f
+		if dest, ok := moved[f.ID.Int64]; ok {
+			st.dests[filepath.Dir(dest)] = true
+		}
+	}
+
+	for dir, st := range dirs {
+		if len(st.dests) == 0 {
+			continue
+		}
+		cars := []sidecar{}
+		fdb.mutex.Lock()
+		err := fdb.db.Select(&cars, `SELECT * FROM sidecars WHERE dir = ?`, dir)
+		fdb.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+
+		left, err := fdb.tracksLeftIn(dir)
+		if err != nil {
+			return err
+		}
+		wholeDir := ""
+		if len(st.dests) == 1 && !left {
+			for dest := range st.dests {
+				wholeDir = dest
+			}
+			for _, f := range st.tracks {
+				if _, ok := moved[f.ID.Int64]; !ok {
+					wholeDir = ""
+				}
+			}
+		}
+
+		for _, car := range cars {
+			target := ""
+			if track, ok := st.tracks[car.Base.String]; ok {
+				if dest, ok := moved[track.ID.Int64]; ok {
+					target = strings.TrimSuffix(dest, filepath.Ext(dest)) + filepath.Ext(car.Path.String)
+				}
+			} else if wholeDir != "" {
+				target = filepath.Join(wholeDir, filepath.Base(car.Path.String))
+			}
+			if target == "" {
+				continue
+			}
+			if err := fdb.moveSidecar(op, car, target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*tracksLeftIn returns true if any file directly in dir that move never
+takes, as it is in missing_tags, rejects or duplicates, is still there.*/
+func (fdb *FileDB) tracksLeftIn(dir string) (bool, error) {
+	prefix := dirPrefix(dir)
+	for _, table := range []string{"missing_tags", "rejects", "duplicates"} {
+		paths := []string{}
+		fdb.mutex.Lock()
+		err := fdb.db.Select(&paths, `SELECT path FROM `+table+` WHERE substr(path, 1, length(?)) = ?`, prefix, prefix)
+		fdb.mutex.Unlock()
+		if err != nil {
+			return false, err
+		}
+		for _, p := range paths {
+			if _, err := os.Stat(p); err == nil && filepath.Dir(p) == dir {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (fdb *FileDB) moveSidecar(op int64, car sidecar, target string) error {
+	src := car.Path.String
+	_, err := os.Stat(target)
+	switch {
+	case err == nil && fdb.dryRun:
+		fmt.Printf("* [dry-run] %s exists; would leave %s behind\n", target, src)
+		return nil
+	case err == nil:
+		log.Printf("Leaving %s behind: %s exists\n", src, target)
+		return fdb.recordConflict(op, &FileEntry{Path: car.Path}, target, "sidecar-skipped", "")
+	case fdb.dryRun:
+		fmt.Printf("* [dry-run] would move %s -> %s\n", src, target)
+		return nil
+	}
+
+	entry, err := fdb.journal(op, "sidecar", 0, src, target, "pending")
+	if err != nil {
+		return err
+	}
+	copied, err := moveFile(src, target, "")
+	if err != nil {
+		fdb.setJournalStatus(entry, "failed")
+		return err
+	}
+	status := "done"
+	if copied {
+		status = "copied"
+	}
+	if err := fdb.setJournalStatus(entry, status); err != nil {
+		return err
+	}
+	return fdb.sidecarMoved(src, target)
+}
+
+//sidecarMoved updates the sidecars row for a file moved from src to dst
+func (fdb *FileDB) sidecarMoved(src, dst string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	_, err := fdb.db.Exec(`UPDATE sidecars SET path = ?, dir = ?, base = ? WHERE path = ?`, dst, filepath.Dir(dst), basename(dst), src)
+	return err
+}
@@ -0,0 +1,92 @@
+package hasher
+
+import (
+	"database/sql"
+	"time"
+)
+
+//DefaultDurationTolerance is how far apart in length two files may be and still be taken for the same recording, unless told otherwise
+const DefaultDurationTolerance = 3 * time.Second
+
+//SetDurationTolerance sets how far apart in length two files may be and still be taken for the same recording
+func (fdb *FileDB) SetDurationTolerance(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	fdb.durationTolerance = d
+}
+
+/*SameLength returns a FileEntryComparison that is True if both durations
+are within tolerance of each other, or either is not known.*/
+func SameLength(tolerance time.Duration) FileEntryComparison {
+	return func(r, o *FileEntry) bool {
+		if !r.DurationMs.Valid || !o.DurationMs.Valid {
+			return true
+		}
+		diff := r.DurationMs.Int64 - o.DurationMs.Int64
+		if diff < 0 {
+			diff = -diff
+		}
+		return diff <= tolerance.Milliseconds()
+	}
+}
+
+//guarded has comp also require the durations be within the tolerance; nil stays nil, as settle splits those by length
+func (fdb *FileDB) guarded(comp FileEntryComparison) FileEntryComparison {
+	if comp == nil {
+		return nil
+	}
+	sameLength := SameLength(fdb.durationTolerance)
+	return func(r, o *FileEntry) bool {
+		return sameLength(r, o) && comp(r, o)
+	}
+}
+
+//differentVersion is a row in different_versions; a file sharing its tags with others that are a different length
+type differentVersion struct {
+	ID         sql.NullInt64  `db:"id"`
+	SetID      sql.NullInt64  `db:"set_id"`
+	Version    sql.NullInt64  `db:"version"`
+	FileID     sql.NullInt64  `db:"file_id"`
+	Path       sql.NullString `db:"path"`
+	Artist     sql.NullString `db:"artist"`
+	Album      sql.NullString `db:"album"`
+	Title      sql.NullString `db:"title"`
+	DurationMs sql.NullInt64  `db:"duration_ms"`
+	FoundAt    sql.NullInt64  `db:"found_at"`
+}
+
+func (*differentVersion) createStmt() string {
+	return `CREATE TABLE IF NOT EXISTS different_versions (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, set_id INTEGER, version INTEGER, file_id INTEGER, path TEXT, artist TEXT, album TEXT, title TEXT, duration_ms INTEGER, found_at INTEGER)`
+}
+
+/*recordVersions lists sets of files that share their tags but not their
+length, such as an album version and a radio edit, in different_versions.
+Files in the same version are only resolved against each other.*/
+func (fdb *FileDB) recordVersions(versions []Duplicates) error {
+	setID := int64(-1)
+	for _, v := range versions {
+		for _, r := range v {
+			if setID < 0 || r.ID.Int64 < setID {
+				setID = r.ID.Int64
+			}
+		}
+	}
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	tx, err := fdb.db.Beginx()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for i, v := range versions {
+		for _, r := range v {
+			if _, err := tx.Exec(`INSERT INTO different_versions (set_id, version, file_id, path, artist, album, title, duration_ms, found_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				setID, i, r.ID.Int64, r.Path.String, r.Artist, r.Album, r.Title, r.DurationMs, now); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
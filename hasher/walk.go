@@ -1,6 +1,8 @@
 package hasher
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -15,9 +17,6 @@ var ignore = []string{
 	".plist",
 	"db_errlog",
 	".strings",
-	".pdf",
-	".png",
-	".gif",
 }
 
 func badApple(path string) bool {
@@ -29,56 +28,242 @@ func badApple(path string) bool {
 	return false
 }
 
-/*PopulateDB creates a db*/
-func (fdb *FileDB) PopulateDB(rootPath string, goroutines int) error {
+//knownFile is a previously scanned file and the table its row currently lives in
+type knownFile struct {
+	*FileEntry
+	table string
+}
+
+//dirPrefix is dir with a single separator on the end, for matching the paths beneath it; "/" stays "/"
+func dirPrefix(dir string) string {
+	return strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+}
+
+/*knownFiles loads the rows already recorded for files under rootPath, keyed by path.
+
+Rows that were moved out of scanned_files by an earlier assemble or analyze are
+included so unchanged files are not re-hashed and re-inserted on every run.*/
+func (fdb *FileDB) knownFiles(rootPath string) (map[string]knownFile, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+
+	prefix := dirPrefix(rootPath)
+	known := map[string]knownFile{}
+	//scanned_files goes last so its rows win
+	for _, table := range []string{"rejects", "missing_tags", "duplicates", "scanned_files"} {
+		recs := []*FileEntry{}
+		if err := fdb.db.Select(&recs, fmt.Sprintf(`SELECT id, path, size, mtime, inode FROM %s`, table)); err != nil {
+			return nil, err
+		}
+		for _, rec := range recs {
+			if strings.HasPrefix(rec.Path.String, prefix) {
+				known[rec.Path.String] = knownFile{FileEntry: rec, table: table}
+			}
+		}
+	}
+	return known, nil
+}
+
+/*markRemoved moves the rows for files no longer on disk from scanned_files into removed*/
+func (fdb *FileDB) markRemoved(ids []int64) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	tx := fdb.db.MustBegin()
+	for _, id := range ids {
+		tx.MustExec(`INSERT INTO removed (`+columnList(true)+`) SELECT `+columnList(true)+` FROM scanned_files WHERE id=?`, id)
+		tx.MustExec(`DELETE FROM scanned_files WHERE id=?`, id)
+	}
+	return tx.Commit()
+}
 
-	files := make(chan string, 16)
-	wg := &sync.WaitGroup{}
-	n := 0
+/*PopulateDB creates a db, or refreshes one from an earlier run.
+
+Files whose size, mtime and inode match what was recorded are skipped, changed
+files have their rows rewritten, and rows for files that have disappeared are
+moved into removed.
+
+The walk feeds goroutines hashers through a short queue, so it never gets far
+ahead of them, and a single writer stores what they read in transactions of up
+to SetBatchSize files, or whatever arrived within SetFlushInterval.
+
+Only the start and end of files that share a size are hashed, and only those
+that still collide are hashed in full; see completeHashes.  SetFullHashing
+has every file hashed in full as it is read instead.
+
+Paths that cannot be walked, read or stored are recorded in scan_errors and
+the scan carries on without them.  If there were any, a ScanErrors is
+returned once everything else is done.
+
+Cancelling ctx stops the walk; files already being hashed are finished and
+stored, and ctx's error is returned.  As unchanged files are skipped, running
+it again picks up where it stopped.*/
+func (fdb *FileDB) PopulateDB(ctx context.Context, rootPath string, goroutines int) error {
+	if abs, err := filepath.Abs(rootPath); err == nil {
+		rootPath = abs
+	}
+	if _, err := os.Stat(rootPath); err != nil {
+		return err
+	}
+	if err := fdb.recordScanRoot(rootPath); err != nil {
+		return err
+	}
+	if err := fdb.clearScanErrors(rootPath); err != nil {
+		return err
+	}
+	known, err := fdb.knownFiles(rootPath)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	unreadable := []string{}
+	sidecars := []string{}
+
+	if goroutines < 1 {
+		goroutines = 1
+	}
+	//bounded, so a walker that gets ahead of the hashers waits for them
+	paths := make(chan string, 2*goroutines)
+	results := make(chan scanned, fdb.batchSize)
+	n, unchanged := 0, 0
 
 	walkfunc := func(wpath string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
-			panic(err)
+			fdb.scanError(wpath, stageWalk, err)
+			if info != nil && info.IsDir() {
+				unreadable = append(unreadable, wpath+string(filepath.Separator))
+			}
+			return nil
 		}
 		if rootPath == wpath || info.IsDir() {
 			log.Printf("Decending into %s\n", wpath)
 			return nil
 		}
+		if isSidecar(wpath) {
+			sidecars = append(sidecars, wpath)
+			return nil
+		}
 		if !badApple(wpath) {
+			seen[wpath] = true
+			if info.Mode()&os.ModeSymlink != 0 {
+				if st, err := os.Stat(wpath); err == nil {
+					info = st
+				}
+			}
+			if prev, ok := known[wpath]; ok && prev.Unchanged(info) {
+				unchanged++
+				return nil
+			}
 			n++
-			wg.Add(1)
-			go func() {
-				files <- wpath
-			}()
+			select {
+			case paths <- wpath:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 		return nil
 	}
 
-	dbwriter := func() {
-		for file := range files {
-			fdb.Insert(NewFileEntry(file))
-			log.Printf("✓: %s\n", file)
-			wg.Done()
-		}
+	scan := func(file string) (entry *FileEntry, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return readFileEntry(file, fdb.fullHash)
 	}
 
+	hashers := &sync.WaitGroup{}
 	for i := 0; i < goroutines; i++ {
-		go dbwriter()
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+			for file := range paths {
+				if ctx.Err() != nil {
+					continue
+				}
+				entry, err := scan(file)
+				if err != nil {
+					fdb.scanError(file, stageRead, err)
+					continue
+				}
+				results <- scanned{entry: entry, prev: known[file]}
+			}
+		}()
+	}
+
+	writer, err := fdb.newBatchWriter(fdb.batchSize, fdb.flushEvery)
+	if err != nil {
+		return err
 	}
+	defer writer.Close()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		writer.run(results)
+	}()
 
 	log.Printf("Starting Travese\n")
 	filepath.Walk(rootPath, walkfunc)
+	close(paths)
 	log.Printf("Awaiting Scan on %d files\n", n)
-	wg.Wait()
+	hashers.Wait()
+	close(results)
+	<-written
+
+	//an interrupted walk has not seen everything, so cannot tell what is gone
+	if ctx.Err() == nil {
+		if err := fdb.recordSidecars(rootPath, sidecars); err != nil {
+			return err
+		}
+		gone := []int64{}
+		for path, prev := range known {
+			if !seen[path] && prev.table == "scanned_files" && !under(path, unreadable) {
+				gone = append(gone, prev.ID.Int64)
+			}
+		}
+		if err := fdb.markRemoved(gone); err != nil {
+			return err
+		}
+		log.Printf("Skipped %d unchanged files, marked %d as removed, found %d sidecars\n", unchanged, len(gone), len(sidecars))
+	}
 	log.Println("Cleanup on isle", n)
 
 	// Move obvious non-music files into rejected immediately
 	fdb.MustExecMany([]string{
-		`INSERT INTO rejects SELECT 'Not Music File' as reason, * FROM scanned_files where lower(extension) not in ('.mp3', '.m4a', '.m4r')`,              // no non-music
-		`DELETE FROM scanned_files WHERE id in (SELECT scanned_files.id from scanned_files INNER JOIN rejects ON scanned_files.id = rejects.id)`,          // ... prune
-		`CREATE TABLE IF NOT EXISTS missing_tags AS SELECT * FROM scanned_files WHERE title IS NULL OR album IS NULL OR  artist IS NULL;`,                 //Missing artists, title, etc - fix the tags first
-		`DELETE FROM scanned_files WHERE id in (SELECT missing_tags.id from missing_tags INNER JOIN scanned_files ON scanned_files.id = missing_tags.id)`, // ... prune
+		`INSERT INTO rejects (reason, ` + columnList(true) + `) SELECT 'Not Music File' as reason, ` + columnList(true) + ` FROM scanned_files where lower(extension) not in ('.mp3', '.m4a', '.m4r')`, // no non-music
+		`DELETE FROM scanned_files WHERE id in (SELECT scanned_files.id from scanned_files INNER JOIN rejects ON scanned_files.id = rejects.id)`,                                                       // ... prune
+		`INSERT INTO missing_tags (` + columnList(true) + `) SELECT ` + columnList(true) + ` FROM scanned_files WHERE title IS NULL OR album IS NULL OR  artist IS NULL;`,                              //Missing artists, title, etc - fix the tags first
+		`DELETE FROM scanned_files WHERE id in (SELECT missing_tags.id from missing_tags INNER JOIN scanned_files ON scanned_files.id = missing_tags.id)`,                                              // ... prune
 	})
-	close(files)
-	return nil
+	if !fdb.fullHash {
+		if err := fdb.completeHashes(ctx, goroutines); err != nil && ctx.Err() == nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		log.Printf("Interrupted; stored what was already scanned\n")
+		return ctx.Err()
+	}
+
+	err = fdb.scanErrors(rootPath)
+	if se, ok := err.(ScanErrors); ok {
+		log.Printf("Could not scan %d paths:\n", se.Count)
+		for class, n := range se.ByClass {
+			log.Printf("\t%-12s %d\n", class, n)
+		}
+	}
+	return err
+}
+
+//under returns true if path is inside any of dirs, which end in a separator
+func under(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(path, dir) {
+			return true
+		}
+	}
+	return false
 }
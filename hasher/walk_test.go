@@ -0,0 +1,71 @@
+package hasher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirPrefix(t *testing.T) {
+	tests := []struct {
+		dir, path string
+		want      bool
+	}{
+		{"/music", "/music/a.mp3", true},
+		{"/music", "/music/A/a.mp3", true},
+		{"/music/", "/music/a.mp3", true},
+		{"/music", "/musicals/a.mp3", false},
+		{"/music", "/music", false},
+		{"/", "/a.mp3", true},
+		{"/", "/music/a.mp3", true},
+	}
+	for _, tt := range tests {
+		if got := strings.HasPrefix(tt.path, dirPrefix(tt.dir)); got != tt.want {
+			t.Errorf("%q under dirPrefix(%q) = %q: %v, want %v", tt.path, tt.dir, dirPrefix(tt.dir), got, tt.want)
+		}
+	}
+	if got := dirPrefix("/"); got != "/" {
+		t.Errorf(`dirPrefix("/") = %q, want "/"`, got)
+	}
+}
+
+func TestKnownFilesUnderRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fdb := CreateFileDB(filepath.Join(dir, "test.db"))
+	defer fdb.Close()
+	for _, p := range []string{"/music/a.mp3", "/musicals/b.mp3"} {
+		if err := fdb.Insert(&FileEntry{Path: ns(p)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		root string
+		want []string
+	}{
+		{"/", []string{"/music/a.mp3", "/musicals/b.mp3"}},
+		{"/music", []string{"/music/a.mp3"}},
+		{"/music/", []string{"/music/a.mp3"}},
+		{"/other", nil},
+	}
+	for _, tt := range tests {
+		known, err := fdb.knownFiles(tt.root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(known) != len(tt.want) {
+			t.Errorf("knownFiles(%q) found %d files, want %d", tt.root, len(known), len(tt.want))
+		}
+		for _, p := range tt.want {
+			if _, ok := known[p]; !ok {
+				t.Errorf("knownFiles(%q) is missing %s", tt.root, p)
+			}
+		}
+	}
+}